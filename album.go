@@ -2,15 +2,17 @@ package gallery
 
 import (
 	"archive/zip"
-	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Album holds information about an album of images.
@@ -18,9 +20,19 @@ type Album struct {
 	// Name.
 	Name string
 
-	// File describing images in the album.
+	// File describing images in the album. If blank, the album is every image
+	// in OrigImageDir.
 	File string
 
+	// How to order the images when there is no album file. This is name or
+	// time (when each was taken). Blank means name.
+	DirOrder string
+
+	// If true, we fill in descriptions that the album file doesn't have from
+	// captions in the images or their XMP sidecar files. We add their keywords
+	// and star ratings (as tags such as rating-5) to the images' tags.
+	ReadMetadata bool
+
 	// Dir containing the original images.
 	OrigImageDir string
 
@@ -42,9 +54,19 @@ type Album struct {
 	// How many images per page.
 	PageSize int
 
-	// Number of workers to use in resizing images.
+	// Number of workers to use in resizing images. If this is not positive, we
+	// use the number of CPUs.
 	Workers int
 
+	// Memory in bytes that images being resized at once may use, as estimated
+	// from their dimensions. 0 means no limit. This prevents several very large
+	// images being decoded at once.
+	MemoryBudget int64
+
+	// Processor decodes and resizes images. If nil, we use the default from
+	// NewImageProcessor().
+	Processor ImageProcessor
+
 	// Whether to log verbosely.
 	Verbose bool
 
@@ -57,6 +79,12 @@ type Album struct {
 	// If false, we don't, and the large image is not a link.
 	IncludeOriginals bool
 
+	// If true, originals in formats browsers can't display (HEIC, RAW) are
+	// converted to JPEG when we install them, and we link to the JPEG.
+	//
+	// If false, we install and link to the original file as it is.
+	ConvertOriginals bool
+
 	// Force generation of images (e.g. thumbs) even if they exist.
 	ForceGenerateImages bool
 
@@ -74,20 +102,132 @@ type Album struct {
 	// not use this field.
 	GalleryName string
 
+	// URL the album is published at, such as https://example.com/album. If
+	// set, pages say what their URL is. Optional.
+	BaseURL string
+
+	// Theme for the pages. This is light, dark, or the path to a CSS file to
+	// add to the light theme. Blank means light.
+	Theme string
+
 	// Tags tells us to include images that has one of these tags. If there are
 	// no tags specified, then include all images.
 	Tags []string
 
+	// MinRating tells us to include only images rated at least this many stars.
+	// 0 means include images whether or not they're rated. If no image has
+	// the rating, the album is empty. A gallery's index leaves it out.
+	MinRating int
+
+	// If true, we show each image's rating as stars.
+	ShowRatings bool
+
+	// How to order the images. One of:
+	//
+	// file: The order of the album file (or the directory, if there is none).
+	// filename: By filename.
+	// time: By when each was taken, oldest first.
+	// time-desc: By when each was taken, newest first.
+	// rating: Highest rated first.
+	// random: Shuffled using SortSeed.
+	//
+	// For images that are otherwise equal, we keep the file's order. We use
+	// the modification time of images that don't say when they were taken.
+	// Blank means file.
+	Sort string
+
+	// Seed for the random order. The same seed gives the same order each time
+	// we build the album. This way pages we already made stay correct.
+	SortSeed int64
+
+	// Group is the section of the gallery index the album is in, if the index
+	// groups albums this way. Optional.
+	Group string
+
+	// If true, we make a page with a map showing where the images were taken.
+	// We know this from Location: lines in the album file, or from the images'
+	// EXIF data.
+	Map bool
+
+	// URL template for the map's tiles. See Gallery.MapTileURL. Blank for the
+	// default.
+	MapTileURL string
+
+	// Attribution for the map's tiles. See Gallery.MapAttribution.
+	MapAttribution string
+
+	// If set, only those who know this password can see the album. We encrypt
+	// its pages and resized images, and its pages decrypt themselves in the
+	// browser once given the password.
+	//
+	// We don't install the originals or zip of a protected album since we
+	// don't encrypt them. It has no map, and we remove any it had. A gallery
+	// shows a placeholder for its thumbnail and leaves it out of its timeline
+	// and map.
+	//
+	// Protected albums must be installed with Install(), not a step at a
+	// time.
+	Password string
+
+	// OnEvent, if set, is called as we make progress. We never call it
+	// concurrently.
+	OnEvent func(Event)
+
 	// All available images. Parsed from the album file.
 	images []*Image
 
 	// A subset of the available images. Those chosen based on tags.
 	chosenImages []*Image
+
+	// Runs jobs such as resizing images. When installing a gallery, all albums
+	// share one.
+	sched *scheduler
+
+	// Where we log. When installing a gallery, each album has its own so that
+	// their messages don't interleave.
+	logger *log.Logger
+
+	// Paths to original images that changed since we last installed. We
+	// regenerate their resized versions even if they exist.
+	changedImages map[string]bool
+
+	// How we encrypt the album if it is protected. See loadLock().
+	lock       *albumLock
+	lockLoaded bool
+
+	// Whether the files we installed before were encrypted differently (or
+	// not at all). If so, we make them all again. So does a gallery with its
+	// pages, since they show the album's images only if it is not protected.
+	relock bool
+
+	// Where we send events. This wraps OnEvent. When installing a gallery, all
+	// albums share one.
+	events     func(Event)
+	eventsOnce sync.Once
 }
 
 // Install loads image information, and then chooses, resizes, builds HTML, and
 // installs the HTML and images.
-func (a *Album) Install() error {
+//
+// If the context is cancelled, we stop starting new jobs, wait for those
+// running to finish, and return the context's error. Since we write files
+// atomically, any files we leave are complete.
+func (a *Album) Install(ctx context.Context) error {
+	a.initEvents()
+	start := time.Now()
+
+	err := a.loadAndInstall(ctx)
+
+	a.emit(Event{
+		Type:     EventAlbumFinished,
+		Duration: time.Since(start),
+		Err:      err,
+	})
+
+	return err
+}
+
+func (a *Album) loadAndInstall(ctx context.Context) error {
 	if err := a.load(); err != nil {
 		return fmt.Errorf("unable to parse metadata file: %s", err)
 	}
@@ -96,27 +236,78 @@ func (a *Album) Install() error {
 		return fmt.Errorf("unable to choose images: %s", err)
 	}
 
-	if err := a.GenerateImages(); err != nil {
-		return fmt.Errorf("problem generating images: %s", err)
+	// Such as a directory without images, or an album file where no image
+	// has the minimum rating. There is nothing to install, but that's not a
+	// reason to stop installing the rest of a gallery.
+	if len(a.images) == 0 {
+		a.log().Printf("Album %s has no images", a.Name)
+	} else if len(a.chosenImages) == 0 {
+		a.log().Printf("Album %s has %d images but none have its tags and minimum rating",
+			a.Name, len(a.images))
 	}
 
-	if err := a.GenerateHTML(); err != nil {
-		return fmt.Errorf("problem generating HTML: %s", err)
+	a.emit(Event{
+		Type:   EventAlbumStarted,
+		Images: len(a.chosenImages),
+	})
+
+	return a.install(ctx)
+}
+
+// install resizes, builds HTML, and installs the HTML and images. The images
+// must have been chosen already.
+//
+// Jobs such as resizing images, copying originals, and making the zip run
+// concurrently using the album's scheduler. Only the HTML waits, since it
+// needs to know about the resized images.
+func (a *Album) install(ctx context.Context) error {
+	if err := makeDirIfNotExist(a.InstallDir); err != nil {
+		return err
 	}
 
-	if a.IncludeOriginals {
-		if err := a.InstallOriginalImages(); err != nil {
-			return fmt.Errorf("unable to install original images: %s", err)
-		}
+	if err := a.loadLock(); err != nil {
+		return err
+	}
+
+	if a.relock && a.protected() {
+		a.warnUnprotectedFiles()
+	}
+
+	imageJobs := a.scheduler().group(ctx)
+	a.generateImages(imageJobs)
+
+	otherJobs := a.scheduler().group(ctx)
+
+	if a.includeOriginals() {
+		a.installOriginalImages(otherJobs)
 	}
 
-	if a.IncludeZip {
-		if err := a.makeZip(); err != nil {
-			return fmt.Errorf("unable to create zip file: %s", err)
+	if a.includeZip() {
+		otherJobs.run(0, func() error {
+			if err := a.makeZip(); err != nil {
+				return fmt.Errorf("unable to create zip file: %s", err)
+			}
+			return nil
+		})
+	}
+
+	if err := imageJobs.wait(); err != nil {
+		_ = otherJobs.wait()
+		return fmt.Errorf("problem generating images: %s", err)
+	}
+
+	otherJobs.run(0, func() error {
+		if err := a.generateHTML(); err != nil {
+			return fmt.Errorf("problem generating HTML: %s", err)
 		}
+		return nil
+	})
+
+	if err := otherJobs.wait(); err != nil {
+		return err
 	}
 
-	return nil
+	return a.saveLock()
 }
 
 // ParseAlbumFile an album file. This file lists images and information about
@@ -126,6 +317,8 @@ func (a *Album) Install() error {
 // Image filename\n
 // Optional: Description\n
 // Optional: Tag: comma separated tags on the image\n
+// Optional: Rating: star rating from 1 to 5, or -1 for a rejected image\n
+// Optional: Location: latitude, longitude where the image was taken\n
 // Blank line
 // Then should come the next filename, or end of file.
 //
@@ -135,134 +328,140 @@ func (a *Album) Install() error {
 // Filename
 // Description
 // Tags
+// Rating
+// Location
 //
 // This is to allow this function to be usable for operating on the album file
-// by itself without assuming we are doing anything with it.
+// by itself without assuming we are doing anything with it. To change the file,
+// use ReadAlbumFile().
 func ParseAlbumFile(file string) ([]*Image, error) {
-	fh, err := os.Open(file)
+	f, err := ReadAlbumFile(file)
 	if err != nil {
-		return nil, fmt.Errorf("unable to open: %s: %s", file, err)
+		return nil, err
 	}
 
-	images := []*Image{}
-
-	scanner := bufio.NewScanner(fh)
+	return f.Images(), nil
+}
 
-	filename := ""
-	description := ""
-	var tags []string
+// load parses an album file to find all of the images, and then fills in
+// information about each found Image. If there is no album file, the images
+// are those in the album's directory.
+//
+// This includes setting each Image's:
+// Path
+// ThumbnailSize
+// LargeImageSize
+func (a *Album) load() error {
+	var images []*Image
+	var err error
+	if a.File == "" {
+		images, err = listImages(a.OrigImageDir, a.DirOrder)
+	} else {
+		images, err = ParseAlbumFile(a.File)
+	}
+	if err != nil {
+		return err
+	}
 
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+	for _, image := range images {
+		image.Path = filepath.Join(a.OrigImageDir, image.Filename)
+		image.ThumbnailSize = a.ThumbnailSize
+		image.LargeImageSize = a.LargeImageSize
 
-		if len(line) > 0 && line[0] == '#' {
-			continue
+		if a.ReadMetadata {
+			// The image may still be fine to show without it, and may have a
+			// location we can read.
+			md, err := readImageMetadata(image.Path)
+			if err != nil {
+				a.log().Printf("Unable to read metadata: %s", err)
+			} else {
+				md.apply(image)
+			}
 		}
 
-		if len(filename) == 0 {
-			// May have blank lines on their own.
-			if len(line) == 0 {
+		if a.Map && image.Location == nil {
+			location, err := readLocation(image.Path)
+			if err != nil {
+				a.log().Printf("Unable to read location: %s", err)
 				continue
 			}
 
-			filename = line
-			continue
+			image.Location = location
 		}
+	}
 
-		// Blank line ends a block describing one file.
-		if len(line) == 0 {
-			// May have blank lines on their own.
-			if len(filename) == 0 {
-				continue
-			}
-
-			images = append(images, &Image{
-				Filename:    filename,
-				Description: description,
-				Tags:        tags,
-			})
+	a.images = images
 
-			filename = ""
-			description = ""
-			tags = nil
-			continue
-		}
+	return nil
+}
 
-		if strings.HasPrefix(line, "Tag: ") && len(line) > 5 {
-			rawTags := strings.Split(line[5:], ",")
+// listImages finds the images in a directory. order is name or time. For
+// time, we order by when each was taken. See ImageTime().
+func listImages(dir, order string) ([]*Image, error) {
+	if order != "" && order != "name" && order != "time" {
+		return nil, fmt.Errorf("invalid order: %s", order)
+	}
 
-			for _, tag := range rawTags {
-				tag = strings.TrimSpace(tag)
-				if len(tag) == 0 {
-					continue
-				}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read directory: %s", err)
+	}
 
-				tags = append(tags, tag)
-			}
+	var images []*Image
 
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
 			continue
 		}
 
-		description = line
-	}
-
-	// May have one last file to store
-	if len(filename) > 0 {
-		images = append(images, &Image{
-			Filename:    filename,
-			Description: description,
-			Tags:        tags,
-		})
-	}
+		path := filepath.Join(dir, name)
 
-	if err := scanner.Err(); err != nil {
-		_ = fh.Close()
-		return nil, fmt.Errorf("scan failure: %s", err)
-	}
-
-	if err := fh.Close(); err != nil {
-		return nil, fmt.Errorf("close: %s", err)
-	}
+		format, err := DetectImageFormat(path)
+		if err != nil {
+			return nil, err
+		}
+		if format == "" {
+			continue
+		}
 
-	return images, nil
-}
+		image := &Image{Filename: name}
+		if order == "time" {
+			image.Time = ImageTime(path)
+		}
 
-// load parses an album file to find all of the images, and then fills in
-// information about each found Image.
-//
-// This includes setting each Image's:
-// Path
-// ThumbnailSize
-// LargeImageSize
-func (a *Album) load() error {
-	images, err := ParseAlbumFile(a.File)
-	if err != nil {
-		return err
+		images = append(images, image)
 	}
 
-	for _, image := range images {
-		image.Path = filepath.Join(a.OrigImageDir, image.Filename)
-		image.ThumbnailSize = a.ThumbnailSize
-		image.LargeImageSize = a.LargeImageSize
+	// ReadDir gives us the images ordered by name.
+	if order == "time" {
+		sort.SliceStable(images, func(i, j int) bool {
+			return images[i].Time.Before(images[j].Time)
+		})
 	}
 
-	a.images = images
-
-	return nil
+	return images, nil
 }
 
 // ChooseImages decides which images we will include when we build the HTML.
 //
 // The basis for this choice is whether the image has one of the requested tags
-// or not.
+// or not, and whether it has the minimum rating. We then order them. See
+// Sort.
 func (a *Album) ChooseImages() error {
-	// No tags wanted? Then include everything.
-	if len(a.Tags) == 0 {
-		a.chosenImages = a.images
-		return nil
-	}
+	a.chosenImages = nil
 
 	for _, image := range a.images {
+		if a.MinRating > 0 && image.Rating < a.MinRating {
+			continue
+		}
+
+		// No tags wanted? Then include everything.
+		if len(a.Tags) == 0 {
+			a.chosenImages = append(a.chosenImages, image)
+			continue
+		}
+
 		for _, wantedTag := range a.Tags {
 			if image.hasTag(wantedTag) {
 				a.chosenImages = append(a.chosenImages, image)
@@ -271,9 +470,75 @@ func (a *Album) ChooseImages() error {
 		}
 	}
 
+	return a.sortImages()
+}
+
+// sortImages puts the chosen images in the order the album asks for.
+func (a *Album) sortImages() error {
+	images := a.chosenImages
+
+	switch a.Sort {
+	case "", "file":
+	case "filename":
+		sort.SliceStable(images, func(i, j int) bool {
+			return images[i].Filename < images[j].Filename
+		})
+	case "time", "time-desc":
+		loadImageTimes(images)
+
+		desc := a.Sort == "time-desc"
+		sort.SliceStable(images, func(i, j int) bool {
+			if desc {
+				return images[i].Time.After(images[j].Time)
+			}
+			return images[i].Time.Before(images[j].Time)
+		})
+	case "rating":
+		sort.SliceStable(images, func(i, j int) bool {
+			return images[i].Rating > images[j].Rating
+		})
+	case "random":
+		r := rand.New(rand.NewSource(a.SortSeed))
+		r.Shuffle(len(images), func(i, j int) {
+			images[i], images[j] = images[j], images[i]
+		})
+	default:
+		return fmt.Errorf("invalid sort: %s", a.Sort)
+	}
+
 	return nil
 }
 
+// newestTime returns when the album's newest image was taken. It is zero if
+// the album has no images or we can't tell.
+func (a *Album) newestTime() time.Time {
+	loadImageTimes(a.chosenImages)
+
+	var newest time.Time
+	for _, image := range a.chosenImages {
+		if image.Time.After(newest) {
+			newest = image.Time
+		}
+	}
+
+	return newest
+}
+
+// loadImageTimes sets the Time of each image that doesn't have one.
+func loadImageTimes(images []*Image) {
+	for _, image := range images {
+		if image.Time.IsZero() {
+			image.Time = ImageTime(image.Path)
+		}
+	}
+}
+
+// Images returns the images we include in the album. The album must be
+// loaded and its images chosen, such as by Gallery.Load().
+func (a *Album) Images() []*Image {
+	return a.chosenImages
+}
+
 // GenerateImages creates smaller images than the original ones for use in the
 // HTML page.
 //
@@ -286,63 +551,353 @@ func (a *Album) ChooseImages() error {
 // do so).
 //
 // We only look at chosen images.
-func (a *Album) GenerateImages() error {
+//
+// If the context is cancelled, we stop starting to generate images and return
+// the context's error.
+//
+// This can't be used on albums that are or were password protected. See
+// checkSteps().
+func (a *Album) GenerateImages(ctx context.Context) error {
+	a.initEvents()
+
 	if err := makeDirIfNotExist(a.InstallDir); err != nil {
 		return err
 	}
 
-	ch := make(chan *Image)
+	if err := a.checkSteps(); err != nil {
+		return err
+	}
 
-	wg := sync.WaitGroup{}
+	jobs := a.scheduler().group(ctx)
+	a.generateImages(jobs)
+	return jobs.wait()
+}
 
-	for i := 0; i < a.Workers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+// generateImages starts jobs to generate the resized images.
+func (a *Album) generateImages(jobs *jobGroup) {
+	proc := a.processor()
 
-			for image := range ch {
-				if err := image.makeImages(
-					a.InstallDir,
-					a.Verbose,
-					a.ForceGenerateImages,
-				); err != nil {
-					log.Printf("Error creating images for %s: %s", image.Filename, err)
-					// Continue to process other images.
-				}
+	for _, image := range a.chosenImages {
+		force := a.ForceGenerateImages || a.relock || a.changedImages[image.Path]
+
+		memory, err := image.memoryEstimate(a.InstallDir, force)
+		if err != nil {
+			a.log().Printf("Error estimating memory for %s: %s", image.Filename,
+				err)
+			// Try anyway.
+		}
+
+		image := image
+		jobs.run(memory, func() error {
+			start := time.Now()
+
+			created, err := image.makeImages(
+				proc,
+				a.InstallDir,
+				a.lock,
+				a.log(),
+				a.Verbose,
+				force,
+			)
+
+			e := Event{
+				Type:     EventImageGenerated,
+				Path:     image.Path,
+				Duration: time.Since(start),
+			}
+			for _, path := range created {
+				e.Bytes += fileSize(path)
 			}
-		}()
-	}
 
-	for _, image := range a.chosenImages {
-		ch <- image
+			if err != nil {
+				a.log().Printf("Error creating images for %s: %s", image.Filename,
+					err)
+				// Continue to process other images.
+				e.Type = EventImageFailed
+				e.Err = err
+			} else if len(created) == 0 {
+				e.Type = EventImageSkipped
+				e.Duration = 0
+			}
+
+			a.emit(e)
+			return nil
+		})
 	}
+}
 
-	close(ch)
+// InstallOriginalImages copies the chosen images into the install directory.
+//
+// If ConvertOriginals is set, images in formats browsers can't display are
+// converted to JPEG rather than copied.
+//
+// We don't if the album is protected.
+//
+// If the context is cancelled, we stop starting to copy images and return the
+// context's error.
+func (a *Album) InstallOriginalImages(ctx context.Context) error {
+	a.initEvents()
 
-	wg.Wait()
+	if a.protected() {
+		return nil
+	}
 
-	return nil
+	if err := makeDirIfNotExist(a.InstallDir); err != nil {
+		return err
+	}
+
+	jobs := a.scheduler().group(ctx)
+	a.installOriginalImages(jobs)
+	return jobs.wait()
 }
 
-// InstallOriginalImages copies the chosen images into the install directory.
-func (a *Album) InstallOriginalImages() error {
+// installOriginalImages starts jobs to copy (or convert) the original images.
+func (a *Album) installOriginalImages(jobs *jobGroup) {
+	proc := a.processor()
+
 	for _, image := range a.chosenImages {
-		origTarget := filepath.Join(a.InstallDir, image.Filename)
+		origTarget := filepath.Join(a.InstallDir, a.originalFilename(image))
 
 		// It may be there already.
 		if _, err := os.Stat(origTarget); err == nil {
 			continue
 		}
 
-		if err := copyFile(image.Path, origTarget); err != nil {
-			return fmt.Errorf("unable to copy %s to %s: %s", image.Path, origTarget,
-				err)
+		image := image
+
+		if a.convertOriginal(image) {
+			memory, err := image.decodeMemoryEstimate()
+			if err != nil {
+				a.log().Printf("Error estimating memory for %s: %s", image.Filename,
+					err)
+				// Try anyway.
+			}
+
+			jobs.run(memory, func() error {
+				if a.Verbose {
+					a.log().Printf("Converting %s to %s...", image.Path, origTarget)
+				}
+
+				start := time.Now()
+				if err := convertToJPEG(proc, image.Path, origTarget); err != nil {
+					return fmt.Errorf("unable to convert original %s to %s: %s",
+						image.Path, origTarget, err)
+				}
+				a.emitOriginalInstalled(origTarget, start)
+				return nil
+			})
+			continue
 		}
+
+		jobs.run(0, func() error {
+			start := time.Now()
+			if err := copyFile(image.Path, origTarget); err != nil {
+				return fmt.Errorf("unable to copy original %s to %s: %s", image.Path,
+					origTarget, err)
+			}
+			a.emitOriginalInstalled(origTarget, start)
+			return nil
+		})
 	}
+}
+
+func (a *Album) emitOriginalInstalled(path string, start time.Time) {
+	a.emit(Event{
+		Type:     EventOriginalInstalled,
+		Path:     path,
+		Duration: time.Since(start),
+		Bytes:    fileSize(path),
+	})
+}
+
+// initEvents sets up sending events to OnEvent, unless we have already.
+func (a *Album) initEvents() {
+	a.eventsOnce.Do(func() {
+		if a.events == nil {
+			a.events = syncEventHandler(a.OnEvent)
+		}
+	})
+}
+
+// emit sends an event about the album.
+func (a *Album) emit(e Event) {
+	if a.events == nil {
+		return
+	}
+
+	e.Album = a.Name
+	a.events(e)
+}
+
+// scheduler returns the scheduler to run jobs with, creating one if
+// necessary.
+func (a *Album) scheduler() *scheduler {
+	if a.sched == nil {
+		a.sched = newScheduler(a.Workers, a.MemoryBudget)
+	}
+	return a.sched
+}
 
+// log returns the logger to log with.
+func (a *Album) log() *log.Logger {
+	if a.logger == nil {
+		return log.Default()
+	}
+	return a.logger
+}
+
+// processor returns the ImageProcessor to use.
+func (a *Album) processor() ImageProcessor {
+	if a.Processor != nil {
+		return a.Processor
+	}
+	return defaultImageProcessor()
+}
+
+// convertOriginal tells us whether we install a JPEG conversion of the
+// image's original rather than the original itself.
+func (a *Album) convertOriginal(image *Image) bool {
+	return a.ConvertOriginals && image.needsConversion()
+}
+
+// protected tells us whether the album is password protected.
+func (a *Album) protected() bool {
+	return a.Password != ""
+}
+
+// includeOriginals tells us whether we install the original images.
+func (a *Album) includeOriginals() bool {
+	return a.IncludeOriginals && !a.protected()
+}
+
+// includeZip tells us whether we make a zip of the images.
+func (a *Album) includeZip() bool {
+	return a.IncludeZip && !a.protected()
+}
+
+// showMap tells us whether we make a map page.
+func (a *Album) showMap() bool {
+	return a.Map && !a.protected()
+}
+
+// loadLock decides how we encrypt the album. If it is protected, we use the
+// lock in the install directory if it has the same password. Otherwise we
+// make a new lock, and so must make all of the album's files again. We must
+// too if the album was protected but no longer is.
+//
+// We don't change the install directory. See saveLock().
+func (a *Album) loadLock() error {
+	if a.lockLoaded {
+		return nil
+	}
+
+	lock, err := readAlbumLock(a.InstallDir)
+	if err != nil {
+		return fmt.Errorf("unable to read lock: %s", err)
+	}
+
+	if !a.protected() {
+		a.relock = lock != nil
+		a.lockLoaded = true
+		return nil
+	}
+
+	if lock != nil {
+		ok, err := lock.unlock(a.Password)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			a.lock = lock
+			a.lockLoaded = true
+			return nil
+		}
+	}
+
+	lock, err = newAlbumLock(a.Password)
+	if err != nil {
+		return err
+	}
+
+	a.lock = lock
+	a.relock = true
+	a.lockLoaded = true
 	return nil
 }
 
+// checkSteps checks that we can install the album a step at a time, such as
+// with GenerateImages() and GenerateHTML(). We can't if it is password
+// protected, or was. Its images and pages must all be encrypted with the same
+// key (or none) before we save its lock. Only Install() knows when they are.
+func (a *Album) checkSteps() error {
+	if err := a.loadLock(); err != nil {
+		return err
+	}
+
+	if a.protected() || a.relock {
+		return fmt.Errorf("album is or was password protected: install it with Install()")
+	}
+
+	return nil
+}
+
+// saveLock saves the lock we installed the album with, or removes the one
+// there if the album is no longer protected. We do this only once we've
+// installed everything. If we're interrupted, next time we know to make
+// everything again.
+func (a *Album) saveLock() error {
+	if !a.relock {
+		return nil
+	}
+
+	if a.lock == nil {
+		path := filepath.Join(a.InstallDir, lockFilename)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove lock: %s", err)
+		}
+	} else if err := a.lock.write(a.InstallDir); err != nil {
+		return fmt.Errorf("unable to write lock: %s", err)
+	}
+
+	return nil
+}
+
+// warnUnprotectedFiles warns about originals and zips in the install
+// directory, such as from when the album was not protected. Anyone can see
+// them. We don't remove them since they may be the originals themselves.
+func (a *Album) warnUnprotectedFiles() {
+	paths := []string{a.getZipPath()}
+	for _, image := range a.chosenImages {
+		paths = append(paths,
+			filepath.Join(a.InstallDir, a.originalFilename(image)))
+	}
+
+	for _, path := range paths {
+		if exists, _ := fileExists(path); exists {
+			a.log().Printf("Warning: album %s is protected but %s is not",
+				a.Name, path)
+		}
+	}
+}
+
+// originalFilename returns the basename of the original image as installed.
+func (a *Album) originalFilename(image *Image) string {
+	if a.convertOriginal(image) {
+		return image.convertedFilename()
+	}
+	return image.Filename
+}
+
+// originalFormat returns the human readable format of the original image as
+// installed.
+func (a *Album) originalFormat(image *Image) string {
+	if a.convertOriginal(image) {
+		return "JPEG"
+	}
+	return image.OriginalFormat()
+}
+
 // Make a zip file containing all images in the album.
 func (a *Album) makeZip() error {
 	zipPath := a.getZipPath()
@@ -355,60 +910,60 @@ func (a *Album) makeZip() error {
 	}
 
 	if a.Verbose {
-		log.Printf("Making zip file: %s...", zipPath)
+		a.log().Printf("Making zip file: %s...", zipPath)
 	}
 
-	zipFH, err := os.Create(zipPath)
-	if err != nil {
+	start := time.Now()
+
+	if err := writeFileAtomic(zipPath, a.writeZip); err != nil {
 		return err
 	}
 
-	zipWriter := zip.NewWriter(zipFH)
+	a.emit(Event{
+		Type:     EventZipWritten,
+		Path:     zipPath,
+		Duration: time.Since(start),
+		Bytes:    fileSize(zipPath),
+	})
+
+	if a.Verbose {
+		a.log().Printf("Wrote zip: %s", zipPath)
+	}
+
+	return nil
+}
+
+// writeZip writes a zip file containing all images in the album.
+func (a *Album) writeZip(w io.Writer) error {
+	zipWriter := zip.NewWriter(w)
 
 	for _, image := range a.chosenImages {
 		imageFH, err := os.Open(image.Path)
 		if err != nil {
-			_ = zipFH.Close()
 			_ = zipWriter.Close()
 			return err
 		}
 
 		zipFileFH, err := zipWriter.Create(image.Filename)
 		if err != nil {
-			_ = zipFH.Close()
 			_ = zipWriter.Close()
 			_ = imageFH.Close()
 			return err
 		}
 
 		if _, err := io.Copy(zipFileFH, imageFH); err != nil {
-			_ = zipFH.Close()
 			_ = zipWriter.Close()
 			_ = imageFH.Close()
 			return err
 		}
 
 		if err := imageFH.Close(); err != nil {
-			_ = zipFH.Close()
 			_ = zipWriter.Close()
 			return err
 		}
 	}
 
-	if err := zipWriter.Close(); err != nil {
-		_ = zipFH.Close()
-		return err
-	}
-
-	if err := zipFH.Close(); err != nil {
-		return err
-	}
-
-	if a.Verbose {
-		log.Printf("Wrote zip: %s", zipPath)
-	}
-
-	return nil
+	return zipWriter.Close()
 }
 
 func (a *Album) getZipPath() string {
@@ -418,11 +973,73 @@ func (a *Album) getZipPath() string {
 // GenerateHTML does just that!
 //
 // Split over several pages if necessary.
+//
+// This can't be used on albums that are or were password protected. See
+// checkSteps().
 func (a *Album) GenerateHTML() error {
+	a.initEvents()
+
+	if err := a.checkSteps(); err != nil {
+		return err
+	}
+
+	return a.generateHTML()
+}
+
+// generateHTML generates the HTML. The lock must be loaded.
+func (a *Album) generateHTML() error {
 	if err := makeDirIfNotExist(a.InstallDir); err != nil {
 		return err
 	}
 
+	style, err := themeCSS(a.Theme)
+	if err != nil {
+		return err
+	}
+
+	force := a.ForceGenerateHTML || a.relock
+
+	if a.protected() {
+		start := time.Now()
+		written, err := writeLockedThumb(a.InstallDir, force)
+		if err != nil {
+			return err
+		}
+		if written {
+			a.emitPageWritten(lockedThumbFilename, start)
+		}
+	}
+
+	mapURL := ""
+	if a.showMap() {
+		features := a.mapFeatures("")
+		if len(features) > 0 {
+			mapURL = mapPageFilename
+		}
+
+		start := time.Now()
+		written, err := makeMapHTML(a.InstallDir, mapPage{
+			Title:       a.Name,
+			BackURL:     "index.html",
+			BackName:    a.Name,
+			Features:    features,
+			TileURL:     mapTileURL(a.MapTileURL),
+			Attribution: mapAttribution(a.MapTileURL, a.MapAttribution),
+		}, style, a.BaseURL, a.log(), a.Verbose, force)
+		if err != nil {
+			return fmt.Errorf("unable to generate map: %s", err)
+		}
+		if written {
+			a.emitPageWritten(mapPageFilename, start)
+		}
+	} else if a.protected() {
+		// Such as from before the album was protected. It says where each image
+		// was taken.
+		if err := removeMapHTML(a.InstallDir); err != nil {
+			return err
+		}
+	}
+
 	var htmlImages []HTMLImage
 
 	page := 1
@@ -434,27 +1051,44 @@ func (a *Album) GenerateHTML() error {
 
 	for i, image := range a.chosenImages {
 		htmlImage := HTMLImage{
-			IncludeOriginals: a.IncludeOriginals,
-			OriginalImageURL: image.Filename,
+			IncludeOriginals: a.includeOriginals(),
+			OriginalImageURL: a.originalFilename(image),
+			OriginalFormat:   a.originalFormat(image),
+			ImageName:        image.Filename,
 			ThumbImageURL:    image.ThumbnailFilename,
 			FullImageURL:     image.LargeImageFilename,
 			Description:      image.Description,
 			Index:            i,
 		}
 
-		if err := makeImagePageHTML(htmlImage, a.InstallDir, len(a.chosenImages),
-			a.Name, a.GalleryName, a.Verbose, a.ForceGenerateHTML, page); err != nil {
+		if a.ShowRatings {
+			htmlImage.Stars = stars(image.Rating)
+		}
+
+		start := time.Now()
+		written, err := makeImagePageHTML(htmlImage, a.InstallDir,
+			len(a.chosenImages), a.Name, a.GalleryName, style, a.BaseURL, a.lock,
+			a.log(), a.Verbose, force, page)
+		if err != nil {
 			return fmt.Errorf("unable to generate image page HTML: %s", err)
 		}
+		if written {
+			a.emitPageWritten(imagePageFilename(i), start)
+		}
 
 		htmlImages = append(htmlImages, htmlImage)
 
 		if len(htmlImages) == a.PageSize {
-			if err := makeAlbumPageHTML(totalPages, len(a.chosenImages), page,
-				htmlImages, a.InstallDir, a.Name, a.GalleryName, a.Verbose,
-				a.ForceGenerateHTML, a.IncludeZip); err != nil {
+			start := time.Now()
+			written, err := makeAlbumPageHTML(totalPages, len(a.chosenImages), page,
+				htmlImages, a.InstallDir, a.Name, a.GalleryName, mapURL, style,
+				a.BaseURL, a.lock, a.log(), a.Verbose, force, a.includeZip())
+			if err != nil {
 				return fmt.Errorf("unable to generate album page HTML: %s", err)
 			}
+			if written {
+				a.emitPageWritten(albumPageFilename(page), start)
+			}
 
 			htmlImages = nil
 			page++
@@ -462,18 +1096,38 @@ func (a *Album) GenerateHTML() error {
 	}
 
 	if len(htmlImages) > 0 {
-		if err := makeAlbumPageHTML(totalPages, len(a.chosenImages), page, htmlImages,
-			a.InstallDir, a.Name, a.GalleryName, a.Verbose, a.ForceGenerateHTML,
-			a.IncludeZip); err != nil {
+		start := time.Now()
+		written, err := makeAlbumPageHTML(totalPages, len(a.chosenImages), page,
+			htmlImages, a.InstallDir, a.Name, a.GalleryName, mapURL, style,
+			a.BaseURL, a.lock, a.log(), a.Verbose, force, a.includeZip())
+		if err != nil {
 			return fmt.Errorf("unable to generate/write HTML: %s", err)
 		}
+		if written {
+			a.emitPageWritten(albumPageFilename(page), start)
+		}
 	}
 
 	return nil
 }
 
-// GetThumb picks a thumbnail to represent the album.
+func (a *Album) emitPageWritten(filename string, start time.Time) {
+	path := filepath.Join(a.InstallDir, filename)
+	a.emit(Event{
+		Type:     EventPageWritten,
+		Path:     path,
+		Duration: time.Since(start),
+		Bytes:    fileSize(path),
+	})
+}
+
+// GetThumb picks a thumbnail to represent the album. This is its first image,
+// so it stays the same each time we install the gallery. It returns nil if the
+// album has no images.
 func (a *Album) GetThumb() *Image {
-	i := rand.Int() % len(a.chosenImages)
-	return a.chosenImages[i]
+	if len(a.chosenImages) == 0 {
+		return nil
+	}
+
+	return a.chosenImages[0]
 }
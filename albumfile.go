@@ -0,0 +1,577 @@
+package gallery
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// AlbumFile is an album file that we can change and write back out without
+// losing anything else in it. We keep comments, blank lines, and the order of
+// everything. If you don't change anything, we write the file back out
+// exactly as it was.
+//
+// For the format of the file, refer to ParseAlbumFile().
+type AlbumFile struct {
+	// Lines before the first entry. Typically comments about the file. Other
+	// than with this header, comments directly above an entry belong to it.
+	header []string
+
+	entries []*AlbumFileEntry
+
+	// Lines after the last entry.
+	trailer []string
+
+	// Whether the last line ends with a newline.
+	finalNewline bool
+}
+
+// AlbumFileEntry is one image's block in an album file.
+type AlbumFileEntry struct {
+	// Lines before the entry, such as blank lines separating it from the
+	// previous entry and comments about it.
+	prefix []string
+
+	// The entry's lines. The first is the filename. The block ends with a
+	// blank line (which is not part of it).
+	lines []string
+}
+
+// Prefixes of the lines holding fields other than the description.
+const (
+	// tagPrefix starts a line listing tags.
+	tagPrefix = "Tag: "
+
+	// ratingPrefix starts a line giving a star rating.
+	ratingPrefix = "Rating: "
+
+	// locationPrefix starts a line giving where the image was taken, as
+	// latitude and longitude.
+	locationPrefix = "Location: "
+)
+
+// fieldPrefixes are all of the field prefixes.
+var fieldPrefixes = []string{tagPrefix, ratingPrefix, locationPrefix}
+
+// ReadAlbumFile reads an album file.
+func ReadAlbumFile(file string) (*AlbumFile, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read: %s: %s", file, err)
+	}
+
+	return NewAlbumFile(data), nil
+}
+
+// NewAlbumFile parses the contents of an album file.
+//
+// Pass nil to start a new, empty file.
+func NewAlbumFile(data []byte) *AlbumFile {
+	f := &AlbumFile{finalNewline: true}
+
+	if len(data) == 0 {
+		return f
+	}
+
+	lines := strings.Split(string(data), "\n")
+	f.finalNewline = lines[len(lines)-1] == ""
+	if f.finalNewline {
+		lines = lines[:len(lines)-1]
+	}
+
+	var pending []string
+	var current *AlbumFileEntry
+
+	for _, raw := range lines {
+		line := strings.TrimSpace(raw)
+
+		if current != nil {
+			// Blank line ends a block describing one file.
+			if len(line) == 0 {
+				current = nil
+				pending = append(pending, raw)
+				continue
+			}
+
+			current.lines = append(current.lines, raw)
+			continue
+		}
+
+		if len(line) == 0 || line[0] == '#' {
+			pending = append(pending, raw)
+			continue
+		}
+
+		current = &AlbumFileEntry{lines: []string{raw}}
+
+		// Before the first entry, lines up to the last blank line are the
+		// file's header. Otherwise they belong to the entry.
+		if len(f.entries) == 0 {
+			split := lastBlankLine(pending) + 1
+			f.header = pending[:split]
+			pending = pending[split:]
+		}
+
+		current.prefix = pending
+		pending = nil
+
+		f.entries = append(f.entries, current)
+	}
+
+	if len(f.entries) == 0 {
+		f.header = pending
+	} else {
+		f.trailer = pending
+	}
+
+	return f
+}
+
+// lastBlankLine returns the index of the last blank line, or -1 if there are
+// none.
+func lastBlankLine(lines []string) int {
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.TrimSpace(lines[i]) == "" {
+			return i
+		}
+	}
+	return -1
+}
+
+// Entries returns the entries in the file, in order.
+func (f *AlbumFile) Entries() []*AlbumFileEntry {
+	return f.entries
+}
+
+// Entry returns the first entry with the given filename, or nil if there is
+// none.
+func (f *AlbumFile) Entry(filename string) *AlbumFileEntry {
+	for _, e := range f.entries {
+		if e.Filename() == filename {
+			return e
+		}
+	}
+	return nil
+}
+
+// Images returns the images described by the file. We fill in the same Image
+// fields as ParseAlbumFile().
+func (f *AlbumFile) Images() []*Image {
+	images := []*Image{}
+
+	for _, e := range f.entries {
+		images = append(images, &Image{
+			Filename:    e.Filename(),
+			Description: e.Description(),
+			Tags:        e.Tags(),
+			Rating:      e.Rating(),
+			Location:    e.Location(),
+		})
+	}
+
+	return images
+}
+
+// Insert adds a new entry for the given filename at the given index. Use
+// len(Entries()) to add it at the end.
+func (f *AlbumFile) Insert(index int, filename string) (*AlbumFileEntry,
+	error) {
+	filename = strings.TrimSpace(filename)
+	if err := validateLine(filename); err != nil {
+		return nil, fmt.Errorf("invalid filename: %s", err)
+	}
+
+	e := &AlbumFileEntry{lines: []string{filename}}
+
+	if err := f.insert(index, e); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Append adds a new entry for the given filename at the end of the file.
+func (f *AlbumFile) Append(filename string) (*AlbumFileEntry, error) {
+	return f.Insert(len(f.entries), filename)
+}
+
+// InsertEntry adds a copy of an entry (such as one from another file) at the
+// given index. We keep its comments.
+func (f *AlbumFile) InsertEntry(index int, e *AlbumFileEntry) error {
+	return f.insert(index, &AlbumFileEntry{
+		prefix: append([]string(nil), e.prefix...),
+		lines:  append([]string(nil), e.lines...),
+	})
+}
+
+func (f *AlbumFile) insert(index int, e *AlbumFileEntry) error {
+	if index < 0 || index > len(f.entries) {
+		return fmt.Errorf("index out of range: %d", index)
+	}
+
+	f.entries = append(f.entries, nil)
+	copy(f.entries[index+1:], f.entries[index:])
+	f.entries[index] = e
+
+	return nil
+}
+
+// Remove removes the entry at the given index, along with the comments above
+// it.
+func (f *AlbumFile) Remove(index int) error {
+	if index < 0 || index >= len(f.entries) {
+		return fmt.Errorf("index out of range: %d", index)
+	}
+
+	f.entries = append(f.entries[:index], f.entries[index+1:]...)
+
+	return nil
+}
+
+// Move moves the entry at index from to index to. Comments above it move with
+// it.
+func (f *AlbumFile) Move(from, to int) error {
+	if from < 0 || from >= len(f.entries) {
+		return fmt.Errorf("index out of range: %d", from)
+	}
+	if to < 0 || to >= len(f.entries) {
+		return fmt.Errorf("index out of range: %d", to)
+	}
+
+	e := f.entries[from]
+	f.entries = append(f.entries[:from], f.entries[from+1:]...)
+
+	f.entries = append(f.entries, nil)
+	copy(f.entries[to+1:], f.entries[to:])
+	f.entries[to] = e
+
+	return nil
+}
+
+// WriteTo writes the file's contents.
+//
+// Each entry must be separated from the previous by a blank line. Entries
+// we read have one. For entries that we've moved or added, we add one if
+// necessary. The first entry needs none since the header has any.
+func (f *AlbumFile) WriteTo(w io.Writer) (int64, error) {
+	var lines []string
+
+	lines = append(lines, f.header...)
+	if len(f.header) > 0 && len(f.entries) > 0 &&
+		lastBlankLine(f.header) != len(f.header)-1 {
+		lines = append(lines, "")
+	}
+
+	for i, e := range f.entries {
+		prefix := e.prefix
+		if i == 0 {
+			prefix = prefix[lastBlankLine(prefix)+1:]
+		} else if lastBlankLine(prefix) == -1 {
+			lines = append(lines, "")
+		}
+
+		lines = append(lines, prefix...)
+		lines = append(lines, e.lines...)
+	}
+
+	lines = append(lines, f.trailer...)
+
+	var buf bytes.Buffer
+	for i, line := range lines {
+		buf.WriteString(line)
+		if i < len(lines)-1 || f.finalNewline {
+			buf.WriteString("\n")
+		}
+	}
+
+	return buf.WriteTo(w)
+}
+
+// Bytes returns the file's contents.
+func (f *AlbumFile) Bytes() []byte {
+	var buf bytes.Buffer
+	_, _ = f.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+// Write writes the file out to the given path. We write it atomically. If the
+// file exists, we keep its permissions.
+func (f *AlbumFile) Write(file string) error {
+	return createFileAtomic(file, func(tmpPath string) error {
+		if err := os.WriteFile(tmpPath, f.Bytes(), 0644); err != nil {
+			return fmt.Errorf("unable to write: %s", err)
+		}
+
+		fi, err := os.Stat(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return fmt.Errorf("unable to stat: %s: %s", file, err)
+		}
+
+		if err := os.Chmod(tmpPath, fi.Mode().Perm()); err != nil {
+			return fmt.Errorf("chmod: %s: %s", tmpPath, err)
+		}
+
+		return nil
+	})
+}
+
+// Filename returns the entry's image filename.
+func (e *AlbumFileEntry) Filename() string {
+	return strings.TrimSpace(e.lines[0])
+}
+
+// Description returns the entry's description. It is blank if there is none.
+func (e *AlbumFileEntry) Description() string {
+	description := ""
+	for _, i := range e.descriptionLines() {
+		description = strings.TrimSpace(e.lines[i])
+	}
+	return description
+}
+
+// Tags returns the entry's tags.
+func (e *AlbumFileEntry) Tags() []string {
+	var tags []string
+
+	for _, i := range e.fieldLines(tagPrefix) {
+		line := strings.TrimSpace(e.lines[i])
+
+		for _, tag := range strings.Split(line[len(tagPrefix):], ",") {
+			tag = strings.TrimSpace(tag)
+			if len(tag) == 0 {
+				continue
+			}
+
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+// Rating returns the entry's star rating. It is 0 if there is none.
+func (e *AlbumFileEntry) Rating() int {
+	rating := 0
+
+	for _, i := range e.fieldLines(ratingPrefix) {
+		line := strings.TrimSpace(e.lines[i])
+
+		// fieldLines only gives us valid ratings.
+		rating, _ = parseRating(line[len(ratingPrefix):])
+	}
+
+	return rating
+}
+
+// Location returns where the entry says the image was taken. It is nil if it
+// doesn't say.
+func (e *AlbumFileEntry) Location() *Location {
+	var location *Location
+
+	for _, i := range e.fieldLines(locationPrefix) {
+		line := strings.TrimSpace(e.lines[i])
+
+		// fieldLines only gives us valid locations.
+		location, _ = ParseLocation(line[len(locationPrefix):])
+	}
+
+	return location
+}
+
+// parseRating parses a star rating. This is 1 to 5, or -1 for a rejected
+// image.
+func parseRating(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rating: %s", s)
+	}
+
+	if n < -1 || n > 5 || n == 0 {
+		return 0, fmt.Errorf("rating must be 1 to 5, or -1: %d", n)
+	}
+
+	return n, nil
+}
+
+// SetDescription sets the entry's description. If it is blank, we remove the
+// description.
+func (e *AlbumFileEntry) SetDescription(description string) error {
+	description = strings.TrimSpace(description)
+
+	if description != "" {
+		if err := validateLine(description); err != nil {
+			return fmt.Errorf("invalid description: %s", err)
+		}
+
+		if isFieldLine(description) {
+			return fmt.Errorf("invalid description: it looks like a field: %s",
+				description)
+		}
+	}
+
+	// We put a new description directly after the filename.
+	e.setLines(e.descriptionLines(), 1, description)
+
+	return nil
+}
+
+// SetTags sets the entry's tags. If there are none, we remove the tags.
+func (e *AlbumFileEntry) SetTags(tags []string) error {
+	var cleanTags []string
+
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+
+		if err := validateLine(tag); err != nil {
+			return fmt.Errorf("invalid tag: %s", err)
+		}
+
+		if strings.Contains(tag, ",") {
+			return fmt.Errorf("invalid tag: it contains a comma: %s", tag)
+		}
+
+		cleanTags = append(cleanTags, tag)
+	}
+
+	line := ""
+	if len(cleanTags) > 0 {
+		line = tagPrefix + strings.Join(cleanTags, ", ")
+	}
+
+	e.setLines(e.fieldLines(tagPrefix), len(e.lines), line)
+
+	return nil
+}
+
+// SetRating sets the entry's star rating. This is 1 to 5, or -1 for a rejected
+// image. If it is 0, we remove the rating.
+func (e *AlbumFileEntry) SetRating(rating int) error {
+	line := ""
+	if rating != 0 {
+		if _, err := parseRating(strconv.Itoa(rating)); err != nil {
+			return err
+		}
+		line = ratingPrefix + strconv.Itoa(rating)
+	}
+
+	e.setLines(e.fieldLines(ratingPrefix), len(e.lines), line)
+
+	return nil
+}
+
+// setLines replaces the lines at the given indexes with one line. It goes
+// where the first of them is, or at index at if there are none. If line is
+// blank we remove them all.
+func (e *AlbumFileEntry) setLines(indexes []int, at int, line string) {
+	if len(indexes) > 0 {
+		at = indexes[0]
+	}
+
+	// Remove from the end so indexes stay valid.
+	for i := len(indexes) - 1; i >= 0; i-- {
+		e.lines = append(e.lines[:indexes[i]], e.lines[indexes[i]+1:]...)
+	}
+
+	if line == "" {
+		return
+	}
+
+	e.lines = append(e.lines, "")
+	copy(e.lines[at+1:], e.lines[at:])
+	e.lines[at] = line
+}
+
+// descriptionLines returns the indexes of the lines that are descriptions.
+// Normally there is at most one. If there are several, the last is the
+// description.
+func (e *AlbumFileEntry) descriptionLines() []int {
+	var indexes []int
+
+	for i := 1; i < len(e.lines); i++ {
+		line := strings.TrimSpace(e.lines[i])
+		if line[0] == '#' || isFieldLine(line) {
+			continue
+		}
+
+		indexes = append(indexes, i)
+	}
+
+	return indexes
+}
+
+// fieldLines returns the indexes of the lines that hold the field with the
+// given prefix.
+func (e *AlbumFileEntry) fieldLines(prefix string) []int {
+	var indexes []int
+
+	for i := 1; i < len(e.lines); i++ {
+		if isField(strings.TrimSpace(e.lines[i]), prefix) {
+			indexes = append(indexes, i)
+		}
+	}
+
+	return indexes
+}
+
+// isFieldLine tells us whether the (trimmed) line in an entry is a field
+// other than the description.
+func isFieldLine(line string) bool {
+	for _, prefix := range fieldPrefixes {
+		if isField(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isField tells us whether the (trimmed) line holds the field with the given
+// prefix.
+//
+// A rating or location line must hold a valid one. Otherwise it is a
+// description, as it was before there were ratings and locations, such as
+// "Location: Vancouver harbour".
+func isField(line, prefix string) bool {
+	if !strings.HasPrefix(line, prefix) || len(line) == len(prefix) {
+		return false
+	}
+
+	value := line[len(prefix):]
+
+	switch prefix {
+	case ratingPrefix:
+		_, err := parseRating(value)
+		return err == nil
+	case locationPrefix:
+		_, err := ParseLocation(value)
+		return err == nil
+	}
+
+	return true
+}
+
+// validateLine checks that the text can go on a line of its own in an album
+// file and be read back as it is.
+func validateLine(text string) error {
+	if text == "" {
+		return fmt.Errorf("it is blank")
+	}
+
+	if strings.ContainsAny(text, "\r\n") {
+		return fmt.Errorf("it contains a newline: %q", text)
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(text), "#") {
+		return fmt.Errorf("it would be read as a comment: %s", text)
+	}
+
+	return nil
+}
@@ -0,0 +1,348 @@
+package gallery
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAlbumFileRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ""},
+		{"one entry", "a.jpg\n"},
+		{"no final newline", "a.jpg\ndesc\n\nb.jpg\nTag: x"},
+		{
+			"comments",
+			"# header\n# more header\n\n# about a\na.jpg\n# inside a\ndesc\n" +
+				"Tag: x, y\n\n# about b\nb.jpg\n\n# trailer\n",
+		},
+		{
+			"runs of blank lines",
+			"\n\n\na.jpg\ndesc\n\n\n\n\nb.jpg\n\n\n",
+		},
+		{
+			"CRLF",
+			"# header\r\n\r\na.jpg\r\ndesc\r\nTag: x\r\n\r\nb.jpg\r\n",
+		},
+		{
+			"trailing whitespace",
+			"a.jpg  \ndesc\t\nTag: x, y \n \t\nb.jpg \n  \n",
+		},
+		{"only comments", "# nothing here\n\n# yet\n"},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "images.txt")
+		if err := os.WriteFile(path, []byte(test.input), 0644); err != nil {
+			t.Fatalf("%s: unable to write file: %s", test.name, err)
+		}
+
+		f, err := ReadAlbumFile(path)
+		if err != nil {
+			t.Errorf("%s: ReadAlbumFile() = %s", test.name, err)
+			continue
+		}
+
+		if got := string(f.Bytes()); got != test.input {
+			t.Errorf("%s: Bytes() = %q, wanted %q", test.name, got, test.input)
+		}
+	}
+}
+
+func TestAlbumFileEdit(t *testing.T) {
+	const input = "# header\n\n# about a\na.jpg\nold\nTag: x\n\nb.jpg\n\n" +
+		"# about c\nc.jpg\n"
+
+	tests := []struct {
+		name   string
+		edit   func(f *AlbumFile) error
+		output string
+	}{
+		{
+			"no change",
+			func(f *AlbumFile) error { return nil },
+			input,
+		},
+		{
+			"insert first",
+			func(f *AlbumFile) error {
+				_, err := f.Insert(0, "new.jpg")
+				return err
+			},
+			"# header\n\nnew.jpg\n\n# about a\na.jpg\nold\nTag: x\n\nb.jpg\n\n" +
+				"# about c\nc.jpg\n",
+		},
+		{
+			"insert in the middle",
+			func(f *AlbumFile) error {
+				_, err := f.Insert(1, "new.jpg")
+				return err
+			},
+			"# header\n\n# about a\na.jpg\nold\nTag: x\n\nnew.jpg\n\nb.jpg\n\n" +
+				"# about c\nc.jpg\n",
+		},
+		{
+			"append",
+			func(f *AlbumFile) error {
+				e, err := f.Append("new.jpg")
+				if err != nil {
+					return err
+				}
+				return e.SetDescription("New")
+			},
+			input + "\nnew.jpg\nNew\n",
+		},
+		{
+			"insert entry",
+			func(f *AlbumFile) error {
+				other := NewAlbumFile([]byte("# about d\nd.jpg\nD\n"))
+				return f.InsertEntry(1, other.Entries()[0])
+			},
+			"# header\n\n# about a\na.jpg\nold\nTag: x\n\n# about d\nd.jpg\nD\n\n" +
+				"b.jpg\n\n# about c\nc.jpg\n",
+		},
+		{
+			"remove first",
+			func(f *AlbumFile) error { return f.Remove(0) },
+			"# header\n\nb.jpg\n\n# about c\nc.jpg\n",
+		},
+		{
+			"remove last",
+			func(f *AlbumFile) error { return f.Remove(2) },
+			"# header\n\n# about a\na.jpg\nold\nTag: x\n\nb.jpg\n",
+		},
+		{
+			"move first to last",
+			func(f *AlbumFile) error { return f.Move(0, 2) },
+			"# header\n\nb.jpg\n\n# about c\nc.jpg\n\n# about a\na.jpg\nold\n" +
+				"Tag: x\n",
+		},
+		{
+			"move last to first",
+			func(f *AlbumFile) error { return f.Move(2, 0) },
+			"# header\n\n# about c\nc.jpg\n\n# about a\na.jpg\nold\nTag: x\n\n" +
+				"b.jpg\n",
+		},
+		{
+			"set description",
+			func(f *AlbumFile) error {
+				return f.Entry("a.jpg").SetDescription("new")
+			},
+			"# header\n\n# about a\na.jpg\nnew\nTag: x\n\nb.jpg\n\n" +
+				"# about c\nc.jpg\n",
+		},
+		{
+			"add description",
+			func(f *AlbumFile) error {
+				return f.Entry("c.jpg").SetDescription("C")
+			},
+			input + "C\n",
+		},
+		{
+			"remove description",
+			func(f *AlbumFile) error {
+				return f.Entry("a.jpg").SetDescription("")
+			},
+			"# header\n\n# about a\na.jpg\nTag: x\n\nb.jpg\n\n# about c\nc.jpg\n",
+		},
+		{
+			"set tags",
+			func(f *AlbumFile) error {
+				return f.Entry("a.jpg").SetTags([]string{"p", " q ", ""})
+			},
+			"# header\n\n# about a\na.jpg\nold\nTag: p, q\n\nb.jpg\n\n" +
+				"# about c\nc.jpg\n",
+		},
+		{
+			"add tags",
+			func(f *AlbumFile) error {
+				return f.Entry("b.jpg").SetTags([]string{"p"})
+			},
+			"# header\n\n# about a\na.jpg\nold\nTag: x\n\nb.jpg\nTag: p\n\n" +
+				"# about c\nc.jpg\n",
+		},
+		{
+			"remove tags",
+			func(f *AlbumFile) error {
+				return f.Entry("a.jpg").SetTags(nil)
+			},
+			"# header\n\n# about a\na.jpg\nold\n\nb.jpg\n\n# about c\nc.jpg\n",
+		},
+	}
+
+	for _, test := range tests {
+		f := NewAlbumFile([]byte(input))
+
+		if err := test.edit(f); err != nil {
+			t.Errorf("%s: edit failed: %s", test.name, err)
+			continue
+		}
+
+		if got := string(f.Bytes()); got != test.output {
+			t.Errorf("%s: Bytes() = %q, wanted %q", test.name, got, test.output)
+		}
+	}
+}
+
+func TestAlbumFileEditErrors(t *testing.T) {
+	f := NewAlbumFile([]byte("a.jpg\n"))
+
+	if _, err := f.Insert(2, "b.jpg"); err == nil {
+		t.Errorf("Insert() out of range succeeded")
+	}
+	if _, err := f.Append("# b.jpg"); err == nil {
+		t.Errorf("Append() of a comment succeeded")
+	}
+	if err := f.Remove(1); err == nil {
+		t.Errorf("Remove() out of range succeeded")
+	}
+	if err := f.Move(0, 1); err == nil {
+		t.Errorf("Move() out of range succeeded")
+	}
+	if err := f.Entry("a.jpg").SetDescription("one\ntwo"); err == nil {
+		t.Errorf("SetDescription() with a newline succeeded")
+	}
+	if err := f.Entry("a.jpg").SetDescription("Tag: x"); err == nil {
+		t.Errorf("SetDescription() with a field succeeded")
+	}
+	if err := f.Entry("a.jpg").SetTags([]string{"a,b"}); err == nil {
+		t.Errorf("SetTags() with a comma succeeded")
+	}
+
+	if got := string(f.Bytes()); got != "a.jpg\n" {
+		t.Errorf("failed edits changed the file: %q", got)
+	}
+}
+
+// ParseAlbumFile must read files in the format from before there were ratings
+// and locations as it always has.
+func TestParseAlbumFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		images []*Image
+	}{
+		{"empty", "", []*Image{}},
+		{"only comments", "# nothing\n\n", []*Image{}},
+		{
+			"filenames only",
+			"a.jpg\n\nb.jpg\n",
+			[]*Image{{Filename: "a.jpg"}, {Filename: "b.jpg"}},
+		},
+		{
+			"descriptions and tags",
+			"# header\n\n# about a\na.jpg\nDesc A\nTag: x, y\nTag: z\n\n\n\n" +
+				"b.jpg\nTag: , w ,\nDesc B\n\nc.jpg\nfirst\nsecond",
+			[]*Image{
+				{Filename: "a.jpg", Description: "Desc A",
+					Tags: []string{"x", "y", "z"}},
+				{Filename: "b.jpg", Description: "Desc B", Tags: []string{"w"}},
+				{Filename: "c.jpg", Description: "second"},
+			},
+		},
+		{
+			"comments inside entries",
+			"a.jpg\n# not a description\nDesc\n",
+			[]*Image{{Filename: "a.jpg", Description: "Desc"}},
+		},
+		{
+			"whitespace and CRLF",
+			"  a.jpg \r\n\tDesc A \r\nTag: x \r\n \r\nb.jpg\r\n",
+			[]*Image{
+				{Filename: "a.jpg", Description: "Desc A", Tags: []string{"x"}},
+				{Filename: "b.jpg"},
+			},
+		},
+		{
+			"empty tag line is a description",
+			"a.jpg\nTag: \n",
+			[]*Image{{Filename: "a.jpg", Description: "Tag:"}},
+		},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "images.txt")
+		if err := os.WriteFile(path, []byte(test.input), 0644); err != nil {
+			t.Fatalf("%s: unable to write file: %s", test.name, err)
+		}
+
+		images, err := ParseAlbumFile(path)
+		if err != nil {
+			t.Errorf("%s: ParseAlbumFile() = %s", test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(images, test.images) {
+			t.Errorf("%s: ParseAlbumFile() = %v, wanted %v", test.name, images,
+				test.images)
+		}
+	}
+}
+
+// Lines that start like a rating or location but don't hold a valid one are
+// descriptions, as they were before there were ratings and locations.
+func TestAlbumFileFieldLikeDescriptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		description string
+		rating      int
+		location    *Location
+	}{
+		{
+			"location description",
+			"a.jpg\nLocation: Vancouver harbour\n",
+			"Location: Vancouver harbour",
+			0,
+			nil,
+		},
+		{
+			"location field",
+			"a.jpg\nLocation: 49.3, -123.1\nDesc\n",
+			"Desc",
+			0,
+			&Location{Latitude: 49.3, Longitude: -123.1},
+		},
+		{
+			"rating description",
+			"a.jpg\nRating: not great\n",
+			"Rating: not great",
+			0,
+			nil,
+		},
+		{
+			"rating field",
+			"a.jpg\nRating: 4\nDesc\n",
+			"Desc",
+			4,
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		e := NewAlbumFile([]byte(test.input)).Entry("a.jpg")
+
+		if got := e.Description(); got != test.description {
+			t.Errorf("%s: Description() = %q, wanted %q", test.name, got,
+				test.description)
+		}
+		if got := e.Rating(); got != test.rating {
+			t.Errorf("%s: Rating() = %d, wanted %d", test.name, got, test.rating)
+		}
+		if got := e.Location(); !reflect.DeepEqual(got, test.location) {
+			t.Errorf("%s: Location() = %v, wanted %v", test.name, got,
+				test.location)
+		}
+
+		// We can write the description back.
+		if err := e.SetDescription(test.description); err != nil {
+			t.Errorf("%s: SetDescription() = %s", test.name, err)
+		}
+	}
+}
@@ -6,18 +6,31 @@
 // tedious. This program adds the new images into the file in the correct spot
 // by merging two album files.
 //
-// Note in order for this program to work the images must be named in a
-// sortable way. For example, IMG_20170213, IMG_20170214, etc. The merging
-// occurs based on sorting by the image's filename.
+// By default we order images by filename. This works if they are named in a
+// sortable way. For example, IMG_20170213, IMG_20170214, etc. You can instead
+// order them by the time they were taken (from EXIF) or by their files'
+// modification times. If the cameras' clocks were not set the same, give an
+// offset to apply to the times of images from each album file.
+//
+// If an image is in both files, or the same image is in both under different
+// names, we report it and keep only the existing entry.
+//
+// We keep the existing file's comments and layout, and the comments of the new
+// entries.
 package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/horgh/gallery"
 )
@@ -25,16 +38,39 @@ import (
 // Args hold command line arguments.
 type Args struct {
 	OriginalAlbumFile string
+	OriginalAlbumDir  string
+	OriginalOffset    time.Duration
 	NewAlbumFile      string
+	NewAlbumDir       string
+	NewOffset         time.Duration
 	OutputFile        string
+	Sort              string
+}
+
+// source is an album file and where its images are.
+type source struct {
+	file *gallery.AlbumFile
+	dir  string
+
+	// Added to the time each image was taken.
+	offset time.Duration
 }
 
-// ByFilename is a type for sorting.
-type ByFilename []*gallery.Image
+// sortKey is what we order images by.
+type sortKey struct {
+	time     time.Time
+	filename string
+}
+
+// merger merges the entries of one album file into another.
+type merger struct {
+	sort string
+	orig *source
+	new  *source
 
-func (f ByFilename) Len() int           { return len(f) }
-func (f ByFilename) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
-func (f ByFilename) Less(i, j int) bool { return f[i].Filename < f[j].Filename }
+	keys   map[string]sortKey
+	hashes map[string][]byte
+}
 
 func main() {
 	args, err := getArgs()
@@ -44,28 +80,42 @@ func main() {
 		os.Exit(1)
 	}
 
-	origImages, err := gallery.ParseAlbumFile(args.OriginalAlbumFile)
+	origFile, err := gallery.ReadAlbumFile(args.OriginalAlbumFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to parse album file: %s: %s",
 			args.OriginalAlbumFile, err)
 		os.Exit(1)
 	}
 
-	newImages, err := gallery.ParseAlbumFile(args.NewAlbumFile)
+	newFile, err := gallery.ReadAlbumFile(args.NewAlbumFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to parse album file: %s: %s",
 			args.NewAlbumFile, err)
 		os.Exit(1)
 	}
 
-	allImages := []*gallery.Image{}
-	allImages = append(allImages, origImages...)
-	allImages = append(allImages, newImages...)
+	m := &merger{
+		sort: args.Sort,
+		orig: &source{
+			file:   origFile,
+			dir:    args.OriginalAlbumDir,
+			offset: args.OriginalOffset,
+		},
+		new: &source{
+			file:   newFile,
+			dir:    args.NewAlbumDir,
+			offset: args.NewOffset,
+		},
+		keys:   map[string]sortKey{},
+		hashes: map[string][]byte{},
+	}
 
-	sort.Sort(ByFilename(allImages))
+	if err := m.merge(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to merge album files: %s", err)
+		os.Exit(1)
+	}
 
-	err = writeAlbumFile(args.OutputFile, allImages)
-	if err != nil {
+	if err := origFile.Write(args.OutputFile); err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to write album file: %s: %s",
 			args.OutputFile, err)
 		os.Exit(1)
@@ -76,8 +126,13 @@ func main() {
 
 func getArgs() (*Args, error) {
 	origAlbumFile := flag.String("album-file", "", "Path to an existing album file.")
+	origAlbumDir := flag.String("album-dir", "", "Path to the directory containing the existing album file's images. Default is the album file's directory.")
+	origOffset := flag.Duration("offset", 0, "Offset to add to the times the existing album file's images were taken, such as -1h30m. For when a camera's clock was wrong.")
 	newAlbumFile := flag.String("new-album-file", "", "Path to the album file with the new images.")
+	newAlbumDir := flag.String("new-album-dir", "", "Path to the directory containing the new images. Default is the new album file's directory.")
+	newOffset := flag.Duration("new-offset", 0, "Offset to add to the times the new images were taken.")
 	outputFile := flag.String("output-file", "", "Path to the new album file to write.")
+	sortBy := flag.String("sort", "name", "How to order images. name to order by filename, time to order by the time they were taken (from EXIF, or else the file's modification time), or mtime to order by the file's modification time.")
 
 	flag.Parse()
 
@@ -94,10 +149,27 @@ func getArgs() (*Args, error) {
 		return nil, fmt.Errorf("you must provide an output file")
 	}
 
+	if *sortBy != "name" && *sortBy != "time" && *sortBy != "mtime" {
+		return nil, fmt.Errorf("invalid sort: %s", *sortBy)
+	}
+
+	if len(*origAlbumDir) == 0 {
+		*origAlbumDir = filepath.Dir(*origAlbumFile)
+	}
+
+	if len(*newAlbumDir) == 0 {
+		*newAlbumDir = filepath.Dir(*newAlbumFile)
+	}
+
 	return &Args{
 		OriginalAlbumFile: *origAlbumFile,
+		OriginalAlbumDir:  *origAlbumDir,
+		OriginalOffset:    *origOffset,
 		NewAlbumFile:      *newAlbumFile,
+		NewAlbumDir:       *newAlbumDir,
+		NewOffset:         *newOffset,
 		OutputFile:        *outputFile,
+		Sort:              *sortBy,
 	}, nil
 }
 
@@ -127,43 +199,36 @@ func readImagesList(file string) ([]string, error) {
 	return images, nil
 }
 
-// For the format of the file we write, refer to gallery.ParseAlbumFile()
-func writeAlbumFile(file string, images []*gallery.Image) error {
-	fh, err := os.Create(file)
-	if err != nil {
-		return err
-	}
-
-	defer func() {
-		err := fh.Close()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Problem closing file: %s: %s", file, err)
-		}
-	}()
-
-	for _, image := range images {
-		err := write(fh, image.Filename+"\n")
+// merge adds the entries in the new album file to the original. Each goes
+// before the first entry that sorts after it. We leave everything else in the
+// original as it was, including comments.
+//
+// We skip and report duplicates.
+func (m *merger) merge() error {
+	for _, entry := range m.new.file.Entries() {
+		duplicate, err := m.findDuplicate(entry.Filename())
 		if err != nil {
 			return err
 		}
 
-		if len(image.Description) > 0 {
-			err := write(fh, image.Description+"\n")
-			if err != nil {
-				return err
+		if duplicate != "" {
+			if duplicate == entry.Filename() {
+				fmt.Printf("Duplicate: %s is in both album files\n", duplicate)
+			} else {
+				fmt.Printf("Duplicate: %s is the same image as %s\n",
+					entry.Filename(), duplicate)
 			}
+			continue
 		}
 
-		if len(image.Tags) > 0 {
-			tagStr := strings.Join(image.Tags, ", ")
-			err := write(fh, tagStr+"\n")
-			if err != nil {
-				return err
-			}
-		}
+		key := m.key(m.new, entry.Filename())
 
-		err = write(fh, "\n")
-		if err != nil {
+		entries := m.orig.file.Entries()
+		index := sort.Search(len(entries), func(i int) bool {
+			return key.less(m.key(m.orig, entries[i].Filename()))
+		})
+
+		if err := m.orig.file.InsertEntry(index, entry); err != nil {
 			return err
 		}
 	}
@@ -171,15 +236,115 @@ func writeAlbumFile(file string, images []*gallery.Image) error {
 	return nil
 }
 
-func write(fh *os.File, s string) error {
-	n, err := fh.WriteString(s)
+// findDuplicate looks for an image in the original album file that is the
+// same as the new image. This is one with the same filename, or a file with
+// the same content. We return its filename, or a blank string if there is
+// none.
+func (m *merger) findDuplicate(filename string) (string, error) {
+	if m.orig.file.Entry(filename) != nil {
+		return filename, nil
+	}
+
+	newPath := filepath.Join(m.new.dir, filename)
+	newInfo, err := os.Stat(newPath)
+	if err != nil {
+		// We can't compare. The album may describe images not present yet.
+		return "", nil
+	}
+
+	for _, entry := range m.orig.file.Entries() {
+		origPath := filepath.Join(m.orig.dir, entry.Filename())
+		origInfo, err := os.Stat(origPath)
+		if err != nil || origInfo.Size() != newInfo.Size() ||
+			os.SameFile(origInfo, newInfo) {
+			continue
+		}
+
+		same, err := m.sameContent(origPath, newPath)
+		if err != nil {
+			return "", err
+		}
+
+		if same {
+			return entry.Filename(), nil
+		}
+	}
+
+	return "", nil
+}
+
+// sameContent checks if the two files have the same content.
+func (m *merger) sameContent(a, b string) (bool, error) {
+	hashA, err := m.hash(a)
 	if err != nil {
-		return fmt.Errorf("unable to write: %s", err)
+		return false, err
 	}
 
-	if n != len(s) {
-		return fmt.Errorf("short write: wrote %d, wanted to write %d", n, len(s))
+	hashB, err := m.hash(b)
+	if err != nil {
+		return false, err
 	}
 
-	return nil
+	return bytes.Equal(hashA, hashB), nil
+}
+
+func (m *merger) hash(path string) ([]byte, error) {
+	if h, ok := m.hashes[path]; ok {
+		return h, nil
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		_ = fh.Close()
+		return nil, fmt.Errorf("unable to read: %s: %s", path, err)
+	}
+
+	if err := fh.Close(); err != nil {
+		return nil, fmt.Errorf("close: %s", err)
+	}
+
+	m.hashes[path] = h.Sum(nil)
+
+	return m.hashes[path], nil
+}
+
+// key works out how to order an image from the given source.
+//
+// When sorting by time, we use the time it was taken plus the source's offset.
+// If we don't know that we use the file's modification time plus the offset.
+// If the file does not exist, it has a zero time, which puts it first.
+func (m *merger) key(src *source, filename string) sortKey {
+	path := filepath.Join(src.dir, filename)
+	if key, ok := m.keys[path]; ok {
+		return key
+	}
+
+	key := sortKey{filename: filename}
+
+	switch m.sort {
+	case "time":
+		if t := gallery.ImageTime(path); !t.IsZero() {
+			key.time = t.Add(src.offset)
+		}
+	case "mtime":
+		if fi, err := os.Stat(path); err == nil {
+			key.time = fi.ModTime()
+		}
+	}
+
+	m.keys[path] = key
+
+	return key
+}
+
+func (k sortKey) less(other sortKey) bool {
+	if !k.time.Equal(other.time) {
+		return k.time.Before(other.time)
+	}
+	return k.filename < other.filename
 }
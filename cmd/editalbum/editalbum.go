@@ -0,0 +1,420 @@
+// This program lets you edit the descriptions, tags, and ratings of images in
+// an album file using your browser.
+//
+// It serves a page showing each image in the album with fields for its
+// description, tags, and rating. Use the arrow keys (while not in a field), or
+// Page Up/Page Down, to move between images. The keys 0 to 5 set the rating.
+// Changes are saved to the album file when you move to another image or press
+// Ctrl+S. We keep comments and the order of images in the file.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/horgh/gallery"
+)
+
+// Args holds command line arguments.
+type Args struct {
+	AlbumFile string
+	AlbumDir  string
+	Listen    string
+}
+
+// editor serves the editing page and saves changes.
+type editor struct {
+	albumFile string
+	albumDir  string
+
+	// Protects the album file.
+	mutex sync.Mutex
+}
+
+// editImage is what the page knows about an image.
+type editImage struct {
+	Filename    string   `json:"filename"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	Rating      int      `json:"rating"`
+}
+
+func main() {
+	log.SetFlags(0)
+
+	args, err := getArgs()
+	if err != nil {
+		log.Printf("Invalid argument: %s", err)
+		log.Printf("Usage: %s [arguments]", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	e := &editor{
+		albumFile: args.AlbumFile,
+		albumDir:  args.AlbumDir,
+	}
+
+	// Make sure we can read it before we start.
+	if _, err := gallery.ParseAlbumFile(e.albumFile); err != nil {
+		log.Fatalf("Unable to parse album file: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", e.handleIndex)
+	mux.HandleFunc("/image/", e.handleImage)
+	mux.HandleFunc("/save", e.handleSave)
+
+	log.Printf("Editing %s at http://%s/", e.albumFile, args.Listen)
+
+	if err := http.ListenAndServe(args.Listen, mux); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func getArgs() (*Args, error) {
+	albumFile := flag.String("album-file", "", "Path to the album file to edit.")
+	albumDir := flag.String("album-dir", "", "Path to the directory containing the album's images. Default is the album file's directory.")
+	listen := flag.String("listen", "localhost:8081", "Address to listen on.")
+
+	flag.Parse()
+
+	if len(*albumFile) == 0 {
+		return nil, fmt.Errorf("you must provide an album file")
+	}
+
+	dir := *albumDir
+	if len(dir) == 0 {
+		dir = filepath.Dir(*albumFile)
+	}
+
+	return &Args{
+		AlbumFile: *albumFile,
+		AlbumDir:  dir,
+		Listen:    *listen,
+	}, nil
+}
+
+// handleIndex serves the editing page.
+func (e *editor) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	e.mutex.Lock()
+	images, err := gallery.ParseAlbumFile(e.albumFile)
+	e.mutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var editImages []editImage
+	for _, image := range images {
+		editImages = append(editImages, editImage{
+			Filename:    image.Filename,
+			Description: image.Description,
+			Tags:        image.Tags,
+			Rating:      image.Rating,
+		})
+	}
+
+	t, err := template.New("page").Parse(pageTemplate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		AlbumFile string
+		Images    []editImage
+	}{
+		AlbumFile: e.albumFile,
+		Images:    editImages,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.Execute(w, data); err != nil {
+		log.Printf("Unable to execute template: %s", err)
+	}
+}
+
+// handleImage serves an original image from the album directory.
+func (e *editor) handleImage(w http.ResponseWriter, r *http.Request) {
+	filename := strings.TrimPrefix(r.URL.Path, "/image/")
+
+	// Only serve files directly in the album directory.
+	if filename == "" || filename != filepath.Base(filename) ||
+		strings.HasPrefix(filename, ".") {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeFile(w, r, filepath.Join(e.albumDir, filename))
+}
+
+// handleSave saves the description, tags, and rating of an image.
+//
+// Other sites' pages can send requests to us too. We only accept JSON, which
+// a browser won't send to us from another site without asking us first (and
+// we don't answer). Browsers that tell us where a request comes from must say
+// it's from our own page.
+func (e *editor) handleSave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		http.Error(w, "content type must be application/json",
+			http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" &&
+		site != "same-origin" {
+		http.Error(w, "cross-site request", http.StatusForbidden)
+		return
+	}
+
+	var image editImage
+	if err := json.NewDecoder(r.Body).Decode(&image); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	af, err := gallery.ReadAlbumFile(e.albumFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	entry := af.Entry(image.Filename)
+	if entry == nil {
+		http.Error(w, "image not found: "+image.Filename, http.StatusBadRequest)
+		return
+	}
+
+	if err := entry.SetDescription(image.Description); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := entry.SetTags(image.Tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := entry.SetRating(image.Rating); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := af.Write(e.albumFile); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Saved %s", image.Filename)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+const pageTemplate = `<!DOCTYPE html>
+<meta charset="utf-8">
+<title>Editing {{.AlbumFile}}</title>
+<style>
+body {
+	margin: 0;
+	padding: 10px;
+	font-family: sans-serif;
+}
+
+#image {
+	max-width: 100%;
+	max-height: 70vh;
+	display: block;
+	margin: 10px 0;
+}
+
+input, select {
+	width: 100%;
+	box-sizing: border-box;
+	font-size: 1.1em;
+	margin-bottom: 5px;
+}
+
+#status {
+	color: #666;
+}
+</style>
+<h1 id="filename"></h1>
+<div id="nav">
+	<button id="previous">Previous</button>
+	<button id="next">Next</button>
+	<span id="position"></span>
+	<span id="status"></span>
+</div>
+<img id="image" alt="">
+<label>Description <input id="description"></label>
+<label>Tags (comma separated) <input id="tags"></label>
+<label>Rating <select id="rating">
+	<option value="0">Not rated</option>
+	<option value="1">★☆☆☆☆</option>
+	<option value="2">★★☆☆☆</option>
+	<option value="3">★★★☆☆</option>
+	<option value="4">★★★★☆</option>
+	<option value="5">★★★★★</option>
+	<option value="-1">Rejected</option>
+</select></label>
+<script>
+"use strict";
+
+var images = {{.Images}} || [];
+var current = 0;
+
+function $(id) {
+	return document.getElementById(id);
+}
+
+function show(index) {
+	if (index < 0 || index >= images.length) {
+		return;
+	}
+	current = index;
+
+	var image = images[current];
+	$("filename").textContent = image.filename;
+	$("position").textContent = (current + 1) + "/" + images.length;
+	$("image").src = "/image/" + encodeURIComponent(image.filename);
+	$("description").value = image.description;
+	$("tags").value = (image.tags || []).join(", ");
+	$("rating").value = String(image.rating || 0);
+
+	// Load the next image in the background.
+	if (current + 1 < images.length) {
+		new Image().src = "/image/" +
+			encodeURIComponent(images[current + 1].filename);
+	}
+}
+
+function parseTags(s) {
+	return s.split(",").map(function(t) {
+		return t.trim();
+	}).filter(function(t) {
+		return t.length > 0;
+	});
+}
+
+function save() {
+	var image = images[current];
+	var description = $("description").value.trim();
+	var tags = parseTags($("tags").value);
+	var rating = parseInt($("rating").value, 10);
+
+	if (description === image.description &&
+		tags.join(",") === (image.tags || []).join(",") &&
+		rating === (image.rating || 0)) {
+		return Promise.resolve();
+	}
+
+	$("status").textContent = "Saving...";
+
+	return fetch("/save", {
+		method: "POST",
+		headers: {"Content-Type": "application/json"},
+		body: JSON.stringify({
+			filename: image.filename,
+			description: description,
+			tags: tags,
+			rating: rating
+		})
+	}).then(function(response) {
+		if (!response.ok) {
+			return response.text().then(function(text) {
+				throw new Error(text);
+			});
+		}
+		image.description = description;
+		image.tags = tags;
+		image.rating = rating;
+		$("status").textContent = "Saved";
+	}).catch(function(err) {
+		$("status").textContent = "Unable to save: " + err.message;
+		throw err;
+	});
+}
+
+function move(delta) {
+	save().then(function() {
+		show(current + delta);
+	}, function() {});
+}
+
+$("previous").addEventListener("click", function() {
+	move(-1);
+});
+
+$("next").addEventListener("click", function() {
+	move(1);
+});
+
+document.addEventListener("keydown", function(evt) {
+	var inField = evt.target.tagName === "INPUT" ||
+		evt.target.tagName === "SELECT";
+
+	if ((evt.ctrlKey || evt.metaKey) && evt.key === "s") {
+		evt.preventDefault();
+		save().catch(function() {});
+		return;
+	}
+
+	if (evt.key === "PageUp" || (!inField && evt.key === "ArrowLeft")) {
+		evt.preventDefault();
+		move(-1);
+		return;
+	}
+
+	if (evt.key === "PageDown" || (!inField && evt.key === "ArrowRight")) {
+		evt.preventDefault();
+		move(1);
+		return;
+	}
+
+	// Enter in a field saves and moves on, which is handy when going through
+	// many images.
+	if (inField && evt.key === "Enter") {
+		evt.preventDefault();
+		move(1);
+		return;
+	}
+
+	if (!inField && evt.key.length === 1 && evt.key >= "0" &&
+		evt.key <= "5") {
+		evt.preventDefault();
+		$("rating").value = evt.key;
+		return;
+	}
+
+	if (inField && evt.key === "Escape") {
+		evt.target.blur();
+	}
+});
+
+show(0);
+</script>
+`
@@ -0,0 +1,408 @@
+// This program finds images that look alike in a gallery.
+//
+// It looks at every image the gallery file's albums include and groups those
+// that look the same or nearly so. This finds the same photo in two albums, or
+// near identical shots taken one after the other. It prints each group along
+// with the album files listing the images. It can also write an HTML page
+// showing the groups side by side.
+//
+// We compare images using perceptual hashes. See gallery.PerceptualHash().
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/horgh/gallery"
+)
+
+// Args holds command line arguments.
+type Args struct {
+	GalleryFile string
+
+	// Images whose hashes differ in at most this many bits are duplicates.
+	Threshold int
+
+	// Path to write an HTML page showing the duplicates to. Blank for none.
+	HTMLFile string
+
+	// Name of the image processor to use. Blank for the default.
+	Processor string
+
+	Workers int
+	Verbose bool
+}
+
+// item is an image in an album.
+type item struct {
+	album *gallery.Album
+	image *gallery.Image
+	hash  uint64
+}
+
+// group is a set of images that look alike.
+type group struct {
+	items []*item
+
+	// How far each item's hash is from the first item's.
+	distances []int
+}
+
+func main() {
+	log.SetFlags(0)
+
+	args, err := getArgs()
+	if err != nil {
+		log.Printf("Invalid argument: %s", err)
+		log.Printf("Usage: %s [arguments]", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	processor, err := gallery.NewImageProcessor(args.Processor)
+	if err != nil {
+		log.Fatalf("Unable to set up image processor: %s", err)
+	}
+
+	g := &gallery.Gallery{File: args.GalleryFile}
+	if err := g.Load(); err != nil {
+		log.Fatal(err)
+	}
+
+	var items []*item
+	for _, album := range g.Albums() {
+		for _, image := range album.Images() {
+			items = append(items, &item{album: album, image: image})
+		}
+	}
+
+	items = hashImages(processor, items, args.Workers, args.Verbose)
+
+	groups := groupDuplicates(items, args.Threshold)
+
+	printGroups(groups)
+
+	if args.HTMLFile != "" {
+		if err := writeHTML(args.HTMLFile, groups); err != nil {
+			log.Fatalf("Unable to write HTML: %s", err)
+		}
+		log.Printf("Wrote %s", args.HTMLFile)
+	}
+}
+
+func getArgs() (*Args, error) {
+	galleryFile := flag.String("gallery-file", "", "Path to the gallery file.")
+	threshold := flag.Int("threshold", 10, "How different images may be and still count as duplicates. This is how many of the 64 bits of their hashes may differ. 0 finds only images that look the same.")
+	htmlFile := flag.String("html", "", "Path to write an HTML page showing the duplicates to.")
+	processor := flag.String("processor", "", fmt.Sprintf("Image processor to use. One of: %s. Default is magick if built in.", strings.Join(gallery.ImageProcessorNames(), ", ")))
+	workers := flag.Int("workers", runtime.NumCPU(), "Number of images to hash at once.")
+	verbose := flag.Bool("verbose", false, "Enable verbose output.")
+
+	flag.Parse()
+
+	if len(*galleryFile) == 0 {
+		return nil, fmt.Errorf("you must provide a gallery file")
+	}
+
+	if *threshold < 0 || *threshold > 64 {
+		return nil, fmt.Errorf("threshold must be between 0 and 64")
+	}
+
+	if *workers < 1 {
+		return nil, fmt.Errorf("workers must be at least 1")
+	}
+
+	return &Args{
+		GalleryFile: *galleryFile,
+		Threshold:   *threshold,
+		HTMLFile:    *htmlFile,
+		Processor:   *processor,
+		Workers:     *workers,
+		Verbose:     *verbose,
+	}, nil
+}
+
+// hashImages computes the hash of each image. We return the items we could
+// hash. We hash each file once even if more than one album includes it.
+func hashImages(processor gallery.ImageProcessor, items []*item, workers int,
+	verbose bool) []*item {
+	paths := map[string]bool{}
+	for _, it := range items {
+		paths[it.image.Path] = true
+	}
+
+	hashes := map[string]uint64{}
+	mutex := sync.Mutex{}
+	sem := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+
+	for path := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(path string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			hash, err := gallery.PerceptualHash(processor, path)
+			if err != nil {
+				log.Printf("Unable to hash image: %s", err)
+				return
+			}
+
+			if verbose {
+				log.Printf("Hashed %s: %016x", path, hash)
+			}
+
+			mutex.Lock()
+			hashes[path] = hash
+			mutex.Unlock()
+		}(path)
+	}
+
+	wg.Wait()
+
+	var hashed []*item
+	for _, it := range items {
+		hash, ok := hashes[it.image.Path]
+		if !ok {
+			continue
+		}
+
+		it.hash = hash
+		hashed = append(hashed, it)
+	}
+
+	return hashed
+}
+
+// groupDuplicates groups images whose hashes are within the threshold of each
+// other. If A is close to B and B is close to C, all three are in a group.
+//
+// We return groups with more than one image, in the order of their first
+// image.
+func groupDuplicates(items []*item, threshold int) []*group {
+	parents := make([]int, len(items))
+	for i := range parents {
+		parents[i] = i
+	}
+
+	var find func(i int) int
+	find = func(i int) int {
+		if parents[i] != i {
+			parents[i] = find(parents[i])
+		}
+		return parents[i]
+	}
+
+	for i := range items {
+		for j := i + 1; j < len(items); j++ {
+			if gallery.HashDistance(items[i].hash, items[j].hash) <= threshold {
+				parents[find(j)] = find(i)
+			}
+		}
+	}
+
+	byRoot := map[int]*group{}
+	var groups []*group
+
+	for i, it := range items {
+		root := find(i)
+
+		g, ok := byRoot[root]
+		if !ok {
+			g = &group{}
+			byRoot[root] = g
+			groups = append(groups, g)
+		}
+
+		g.items = append(g.items, it)
+		g.distances = append(g.distances,
+			gallery.HashDistance(g.items[0].hash, it.hash))
+	}
+
+	var duplicates []*group
+	for _, g := range groups {
+		if len(g.items) > 1 {
+			duplicates = append(duplicates, g)
+		}
+	}
+
+	return duplicates
+}
+
+func printGroups(groups []*group) {
+	if len(groups) == 0 {
+		fmt.Println("No duplicates found.")
+		return
+	}
+
+	for i, g := range groups {
+		fmt.Printf("Group %d:\n", i+1)
+
+		for j, it := range g.items {
+			fmt.Printf("  %s: %s (album %s, distance %d)\n", albumSource(it.album),
+				it.image.Filename, it.album.Name, g.distances[j])
+		}
+	}
+
+	// Summarize by album file so it's clear which files to edit.
+	counts := map[string]int{}
+	for _, g := range groups {
+		for _, it := range g.items {
+			counts[albumSource(it.album)]++
+		}
+	}
+
+	var files []string
+	for file := range counts {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	fmt.Printf("\nFound %d groups of duplicates. Albums with them:\n",
+		len(groups))
+	for _, file := range files {
+		fmt.Printf("  %s: %d images\n", file, counts[file])
+	}
+}
+
+// albumSource returns the album's file. For an album without one, which is
+// every image in its directory, we return the directory.
+func albumSource(album *gallery.Album) string {
+	if album.File == "" {
+		return album.OrigImageDir
+	}
+	return album.File
+}
+
+// htmlItem is what the HTML page shows about an image.
+type htmlItem struct {
+	URL       string
+	Filename  string
+	Album     string
+	AlbumFile string
+	Distance  int
+}
+
+// htmlGroup is a group of duplicates on the HTML page.
+type htmlGroup struct {
+	Number int
+	Items  []htmlItem
+}
+
+// writeHTML writes a page showing each group of duplicates side by side. The
+// page links to the original images by their paths relative to it.
+func writeHTML(file string, groups []*group) error {
+	t, err := template.New("page").Parse(htmlTemplate)
+	if err != nil {
+		return fmt.Errorf("unable to parse template: %s", err)
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return err
+	}
+
+	var htmlGroups []htmlGroup
+	for i, g := range groups {
+		var items []htmlItem
+
+		for i, it := range g.items {
+			path, err := filepath.Abs(it.image.Path)
+			if err != nil {
+				return err
+			}
+
+			if rel, err := filepath.Rel(dir, path); err == nil {
+				path = rel
+			}
+
+			items = append(items, htmlItem{
+				URL:       filepath.ToSlash(path),
+				Filename:  it.image.Filename,
+				Album:     it.album.Name,
+				AlbumFile: albumSource(it.album),
+				Distance:  g.distances[i],
+			})
+		}
+
+		htmlGroups = append(htmlGroups, htmlGroup{Number: i + 1, Items: items})
+	}
+
+	fh, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	if err := t.Execute(fh, htmlGroups); err != nil {
+		_ = fh.Close()
+		return fmt.Errorf("unable to execute template: %s", err)
+	}
+
+	if err := fh.Close(); err != nil {
+		return fmt.Errorf("close: %s", err)
+	}
+
+	return nil
+}
+
+const htmlTemplate = `<!DOCTYPE html>
+<meta charset="utf-8">
+<title>Duplicate images</title>
+<style>
+body {
+	font-family: sans-serif;
+}
+
+.group {
+	display: flex;
+	flex-wrap: wrap;
+	gap: 10px;
+	padding: 10px 0;
+	border-bottom: 1px solid #ccc;
+}
+
+figure {
+	margin: 0;
+	width: 250px;
+}
+
+img {
+	max-width: 250px;
+	max-height: 250px;
+}
+
+figcaption {
+	font-size: 0.9em;
+	word-break: break-all;
+}
+</style>
+<h1>Duplicate images</h1>
+{{if not .}}
+<p>No duplicates found.</p>
+{{end}}
+{{range .}}
+<h2>Group {{.Number}}</h2>
+<div class="group">
+	{{range .Items}}
+	<figure>
+		<a href="{{.URL}}"><img src="{{.URL}}" alt="{{.Filename}}"></a>
+		<figcaption>
+			{{.Filename}}<br>
+			{{.Album}} ({{.AlbumFile}})<br>
+			Distance {{.Distance}}
+		</figcaption>
+	</figure>
+	{{end}}
+</div>
+{{end}}
+`
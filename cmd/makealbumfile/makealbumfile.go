@@ -0,0 +1,316 @@
+// This program creates album files listing the images in directories.
+//
+// Give it one or more directories. For each it writes an album file in the
+// directory listing the images in it. We decide what is an image by looking at
+// each file's content, so videos and other files are left out.
+//
+// If there is an album file already, we add any images it does not list. We
+// keep everything in the file as it is, including descriptions and comments.
+//
+// For the format of the album file, refer to gallery.ParseAlbumFile().
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/horgh/gallery"
+)
+
+// Args holds command line arguments.
+type Args struct {
+	Dirs          []string
+	Subdirs       bool
+	AlbumFilename string
+	Sort          string
+	Description   string
+	Tags          []string
+	Exclude       []string
+	Verbose       bool
+}
+
+// sortKey is what we order images by.
+type sortKey struct {
+	time     time.Time
+	filename string
+}
+
+func main() {
+	log.SetFlags(0)
+
+	args, err := getArgs()
+	if err != nil {
+		log.Printf("Invalid argument: %s", err)
+		log.Printf("Usage: %s [arguments] <directory> [directory...]",
+			os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	dirs := args.Dirs
+	if args.Subdirs {
+		dirs, err = findSubdirs(args.Dirs)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	failed := false
+	for _, dir := range dirs {
+		if err := makeAlbumFile(args, dir); err != nil {
+			log.Printf("%s: %s", dir, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func getArgs() (*Args, error) {
+	subdirs := flag.Bool("subdirs", false, "Treat the directories as holding albums. Write an album file for each subdirectory of them.")
+	albumFilename := flag.String("album-filename", "images.txt", "Name of the album file to write in each directory.")
+	sortBy := flag.String("sort", "name", "How to order images. name to order by filename, or time to order by the time they were taken (from EXIF, or else the file's modification time).")
+	description := flag.String("description", "", "Description to give each image we add.")
+	tags := flag.String("tags", "", "Comma separated tags to give each image we add.")
+	exclude := flag.String("exclude", "", "Comma separated filename patterns to leave out, such as '*-edited.jpg'.")
+	verbose := flag.Bool("verbose", false, "Enable verbose output.")
+
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		return nil, fmt.Errorf("you must provide at least one directory")
+	}
+
+	if *albumFilename == "" || *albumFilename != filepath.Base(*albumFilename) {
+		return nil, fmt.Errorf("album filename must be a filename: %s",
+			*albumFilename)
+	}
+
+	if *sortBy != "name" && *sortBy != "time" {
+		return nil, fmt.Errorf("invalid sort: %s", *sortBy)
+	}
+
+	excludes := splitList(*exclude)
+	for _, pattern := range excludes {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern: %s: %s", pattern, err)
+		}
+	}
+
+	return &Args{
+		Dirs:          flag.Args(),
+		Subdirs:       *subdirs,
+		AlbumFilename: *albumFilename,
+		Sort:          *sortBy,
+		Description:   *description,
+		Tags:          splitList(*tags),
+		Exclude:       excludes,
+		Verbose:       *verbose,
+	}, nil
+}
+
+// splitList splits a comma separated list, dropping blank items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// findSubdirs returns the subdirectories of each of the directories. We skip
+// hidden ones.
+func findSubdirs(dirs []string) ([]string, error) {
+	var subdirs []string
+
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read directory: %s: %s", dir, err)
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			subdirs = append(subdirs, filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	return subdirs, nil
+}
+
+// makeAlbumFile writes the album file for a directory, or adds images it does
+// not list to it if it exists.
+func makeAlbumFile(args *Args, dir string) error {
+	file := filepath.Join(dir, args.AlbumFilename)
+
+	af, err := gallery.ReadAlbumFile(file)
+	if err != nil {
+		if _, statErr := os.Stat(file); !os.IsNotExist(statErr) {
+			return err
+		}
+		af = gallery.NewAlbumFile(nil)
+	}
+
+	filenames, err := findImages(args, dir)
+	if err != nil {
+		return err
+	}
+
+	found := map[string]bool{}
+	for _, filename := range filenames {
+		found[filename] = true
+	}
+
+	listed := map[string]bool{}
+	for _, entry := range af.Entries() {
+		listed[entry.Filename()] = true
+
+		if !found[entry.Filename()] {
+			log.Printf("Warning: %s lists %s but it is not an image in %s", file,
+				entry.Filename(), dir)
+		}
+	}
+
+	keys := map[string]sortKey{}
+	key := func(filename string) sortKey {
+		k, ok := keys[filename]
+		if !ok {
+			k = makeSortKey(args, dir, filename)
+			keys[filename] = k
+		}
+		return k
+	}
+
+	var added []string
+	for _, filename := range filenames {
+		if !listed[filename] {
+			added = append(added, filename)
+		}
+	}
+
+	sort.Slice(added, func(i, j int) bool {
+		return key(added[i]).less(key(added[j]))
+	})
+
+	for _, filename := range added {
+		// Put it before the first image that comes after it.
+		entries := af.Entries()
+		index := sort.Search(len(entries), func(i int) bool {
+			return key(filename).less(key(entries[i].Filename()))
+		})
+
+		entry, err := af.Insert(index, filename)
+		if err != nil {
+			return err
+		}
+
+		if err := entry.SetDescription(args.Description); err != nil {
+			return err
+		}
+
+		if err := entry.SetTags(args.Tags); err != nil {
+			return err
+		}
+	}
+
+	if len(added) == 0 {
+		if args.Verbose {
+			log.Printf("No new images for %s", file)
+		}
+		return nil
+	}
+
+	if err := af.Write(file); err != nil {
+		return fmt.Errorf("unable to write album file: %s", err)
+	}
+
+	log.Printf("Wrote %s (%d new images)", file, len(added))
+
+	return nil
+}
+
+// findImages returns the filenames of the images in the directory, sorted.
+func findImages(args *Args, dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read directory: %s", err)
+	}
+
+	var filenames []string
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if entry.IsDir() || strings.HasPrefix(name, ".") ||
+			name == args.AlbumFilename || isExcluded(args.Exclude, name) {
+			continue
+		}
+
+		format, err := gallery.DetectImageFormat(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		if format == "" {
+			if args.Verbose {
+				log.Printf("Skipping %s: not a supported image",
+					filepath.Join(dir, name))
+			}
+			continue
+		}
+
+		filenames = append(filenames, name)
+	}
+
+	sort.Strings(filenames)
+
+	return filenames, nil
+}
+
+// isExcluded checks if the filename matches one of the patterns.
+func isExcluded(patterns []string, filename string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, filename); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// makeSortKey works out how to order the image.
+//
+// When sorting by time, we use the time it was taken. If we don't know that we
+// use the file's modification time. If the file does not exist, it has a zero
+// time, which puts it first.
+func makeSortKey(args *Args, dir, filename string) sortKey {
+	key := sortKey{filename: filename}
+
+	if args.Sort != "time" {
+		return key
+	}
+
+	key.time = gallery.ImageTime(filepath.Join(dir, filename))
+
+	return key
+}
+
+func (k sortKey) less(other sortKey) bool {
+	if !k.time.Equal(other.time) {
+		return k.time.Before(other.time)
+	}
+	return k.filename < other.filename
+}
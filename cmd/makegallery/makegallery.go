@@ -2,13 +2,24 @@
 // This program creates a gallery website. A gallery is made up of one or
 // more albums of images.
 //
+// Run it as "makegallery serve [arguments]" to build the gallery, serve it
+// over HTTP, and rebuild it when its files change. Pages in the browser reload
+// after each rebuild.
+//
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 
 	"github.com/horgh/gallery"
 )
@@ -33,6 +44,9 @@ type Args struct {
 	// See description of this option in Album.
 	IncludeOriginals bool
 
+	// See description of this option in Album.
+	ConvertOriginals bool
+
 	// Force generation of images (e.g. thumbs) even if they exist.
 	ForceGenerateImages bool
 
@@ -48,11 +62,60 @@ type Args struct {
 	// Number of workers to use when resizing images.
 	Workers int
 
+	// Memory in bytes that images being resized at once may use.
+	MemoryBudget int64
+
+	// Name of the image processor to use. Blank for the default.
+	Processor string
+
 	// See definition in Album.
 	ThumbnailSize int
 
 	// See definition in Album.
 	LargeImageSize int
+
+	// Whether to show a progress bar.
+	Progress bool
+
+	// Whether to log build events as JSON.
+	EventsJSON bool
+
+	// Whether to report what we would do rather than doing it.
+	DryRun bool
+
+	// Whether to serve the gallery and rebuild it on changes.
+	Serve bool
+
+	// Address to serve the gallery on.
+	Listen string
+
+	// See definition in Gallery.
+	BaseURL string
+
+	// See definition in Gallery.
+	Theme string
+
+	// See definition in Gallery.
+	IndexPageSize int
+
+	// See definition in Gallery.
+	IndexSort string
+
+	// See definition in Gallery.
+	IndexGroup string
+
+	// See definition in Gallery.
+	Timeline bool
+
+	// See definition in Gallery.
+	MapTileURL string
+
+	// See definition in Gallery.
+	MapAttribution string
+
+	// Names of the flags given on the command line. These override settings in
+	// the gallery file.
+	SetFlags map[string]bool
 }
 
 func main() {
@@ -61,62 +124,164 @@ func main() {
 	args, err := getArgs()
 	if err != nil {
 		log.Printf("Invalid argument: %s", err)
-		log.Printf("Usage: %s [arguments]", os.Args[0])
+		log.Printf("Usage: %s [serve] [arguments]", os.Args[0])
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
+	processor, err := gallery.NewImageProcessor(args.Processor)
+	if err != nil {
+		log.Fatalf("Unable to set up image processor: %s", err)
+	}
+
+	// We draw the progress bar on stderr. Don't mix it with verbose logging.
+	progress := newProgress(os.Stderr, args.Progress && !args.Verbose)
+
+	var jsonEvents func(gallery.Event)
+	if args.EventsJSON {
+		jsonEvents = gallery.SlogEventHandler(
+			slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	}
+
+	onEvent := func(e gallery.Event) {
+		progress.handle(e)
+		if jsonEvents != nil {
+			jsonEvents(e)
+		}
+	}
+
 	gallery := &gallery.Gallery{
 		File:                args.GalleryFile,
-		InstallDir:          args.InstallDir,
-		Name:                args.Name,
 		Verbose:             args.Verbose,
-		IncludeZips:         args.IncludeZips,
-		IncludeOriginals:    args.IncludeOriginals,
 		ForceGenerateImages: args.ForceGenerateImages,
 		ForceGenerateHTML:   args.ForceGenerateHTML,
 		ForceGenerateZip:    args.ForceGenerateZip,
-		PageSize:            args.PageSize,
 		Workers:             args.Workers,
-		ThumbnailSize:       args.ThumbnailSize,
-		LargeImageSize:      args.LargeImageSize,
+		MemoryBudget:        args.MemoryBudget,
+		Processor:           processor,
+		OnEvent:             onEvent,
+	}
+
+	if err := configure(gallery, args); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(gallery.InstallDir) == 0 && !args.Serve {
+		log.Fatalf("You must provide an install directory")
+	}
+
+	if args.DryRun {
+		if err := printPlan(gallery, args.Verbose); err != nil {
+			log.Fatalf("Unable to plan gallery: %s", err)
+		}
+		return
 	}
 
-	err = gallery.Install()
+	// Stop cleanly if interrupted. Files we've written are complete, so running
+	// again picks up where we left off.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt,
+		syscall.SIGTERM)
+	defer stop()
+
+	if args.Serve {
+		// We log each rebuild rather than showing progress.
+		gallery.OnEvent = jsonEvents
+
+		if gallery.InstallDir == "" {
+			dir, err := os.MkdirTemp("", "gallery-")
+			if err != nil {
+				log.Fatalf("Unable to create install directory: %s", err)
+			}
+			gallery.InstallDir = dir
+		}
+
+		reconfigure := func() error {
+			// Keep serving from the same directory.
+			installDir := gallery.InstallDir
+			err := configure(gallery, args)
+			gallery.InstallDir = installDir
+			return err
+		}
+
+		if err := serve(ctx, gallery, args.Listen, reconfigure); err != nil {
+			log.Fatalf("Unable to serve gallery: %s", err)
+		}
+		return
+	}
+
+	err = gallery.Install(ctx)
+	progress.finish()
 	if err != nil {
+		if ctx.Err() != nil {
+			log.Fatalf("Interrupted")
+		}
 		log.Fatalf("Unable to install gallery: %s", err)
 	}
 }
 
 func getArgs() (*Args, error) {
-	galleryFile := flag.String("gallery-file", "", "Path to a file describing the gallery to build.")
-	installDir := flag.String("install-dir", "", "Path to a directory to output HTML/images.")
+	serve := false
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve = true
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
+	galleryFile := flag.String("gallery-file", "", "Path to a file describing the gallery to build. It may also hold settings. Flags given here take precedence over them.")
+	installDir := flag.String("install-dir", "", "Path to a directory to output HTML/images. Optional when serving, in which case we use a temporary directory.")
 	title := flag.String("title", "Gallery", "Name/title of the gallery.")
 	verbose := flag.Bool("verbose", false, "Toggle verbose logging.")
 	includeZips := flag.Bool("include-zips", false, "Generate and link zip files containing images.")
 	includeOriginals := flag.Bool("include-originals", true, "Copy original images and link to them from the single image page")
+	convertOriginals := flag.Bool("convert-originals", false, "Convert originals browsers can't display (HEIC, RAW) to JPEG when copying them.")
 	pageSize := flag.Int("page-size", 50, "Number of image thumbnails per page in albums.")
 	forceGenerateImages := flag.Bool("generate-images", false, "Force regenerating resized images. Normally we only do so if they don't exist.")
 	forceGenerateHTML := flag.Bool("generate-html", false, "Force regenerating HTML. Normally we only do so if it does not exist.")
 	forceGenerateZip := flag.Bool("generate-zip", false, "Force regenerating zip files. Normally we only do so if they do not exist.")
-	workers := flag.Int("workers", 4, "Number of workers for image resizing.")
+	workers := flag.Int("workers", runtime.NumCPU(), "Number of workers for image resizing.")
+	memoryBudget := flag.Int64("memory-budget", 0, "Memory (in MiB) that images being resized at once may use, as estimated from their size. 0 means no limit.")
+	processor := flag.String("processor", "", fmt.Sprintf("Image processor to use. One of: %s. Default is magick if built in.", strings.Join(gallery.ImageProcessorNames(), ", ")))
 	thumbnailSize := flag.Int("thumbnail-size", 100, "Thumbnail size. Width and height will be the same.")
 	largeImageSize := flag.Int("large-image-size", 595, "Larger version of the image. This defines the size of the largest side.")
+	progress := flag.Bool("progress", isTerminal(os.Stderr), "Show a progress bar. Not shown with -verbose. Default is to show it if stderr is a terminal.")
+	dryRun := flag.Bool("dry-run", false, "Report which files would be created or regenerated, but don't change anything. With -verbose, report files we'd leave alone too.")
+	listen := flag.String("listen", "localhost:8080", "Address to listen on when serving.")
+	eventsJSON := flag.Bool("events-json", false, "Log build events to stderr as JSON.")
+	baseURL := flag.String("base-url", "", "URL the gallery is published at, such as https://example.com/gallery. If set, pages say what their URL is.")
+	theme := flag.String("theme", "light", "Theme for the pages. light, dark, or the path to a CSS file to add to the light theme.")
+	indexPageSize := flag.Int("index-page-size", 0, "Number of albums per page on the gallery index. 0 means all on one page.")
+	indexSort := flag.String("index-sort", "file", "How to order albums on the gallery index. file (gallery file order), name, or newest (by their newest image).")
+	indexGroup := flag.String("index-group", "", "How to group albums into sections on the gallery index. year (of their newest image) or group (their album-group). Default is no sections.")
+	timeline := flag.Bool("timeline", false, "Make pages showing images from all albums by the year and month they were taken.")
+	mapTileURL := flag.String("map-tile-url", "", "URL template for map tiles, such as https://tiles.example.com/{z}/{x}/{y}.png. Default is OpenStreetMap's. Albums have maps if the gallery file says so (album-map).")
+	mapAttribution := flag.String("map-attribution", "", "Attribution for the map tiles. Default is OpenStreetMap's if using their tiles.")
 
 	flag.Parse()
 
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
 	if len(*galleryFile) == 0 {
 		return nil, fmt.Errorf("you must provide a gallery file")
 	}
 
-	if len(*installDir) == 0 {
-		return nil, fmt.Errorf("you must provide an install directory")
-	}
-
 	if len(*title) == 0 {
 		return nil, fmt.Errorf("you must provide a title")
 	}
 
+	if *indexPageSize < 0 {
+		return nil, fmt.Errorf("index page size must not be negative")
+	}
+
+	if err := gallery.CheckIndexSort(*indexSort); err != nil {
+		return nil, err
+	}
+
+	if err := gallery.CheckIndexGroup(*indexGroup); err != nil {
+		return nil, err
+	}
+
 	return &Args{
 		GalleryFile:         *galleryFile,
 		InstallDir:          *installDir,
@@ -124,12 +289,146 @@ func getArgs() (*Args, error) {
 		Verbose:             *verbose,
 		IncludeZips:         *includeZips,
 		IncludeOriginals:    *includeOriginals,
+		ConvertOriginals:    *convertOriginals,
 		PageSize:            *pageSize,
 		ForceGenerateImages: *forceGenerateImages,
 		ForceGenerateHTML:   *forceGenerateHTML,
 		ForceGenerateZip:    *forceGenerateZip,
 		Workers:             *workers,
+		MemoryBudget:        *memoryBudget * 1024 * 1024,
+		Processor:           *processor,
 		ThumbnailSize:       *thumbnailSize,
 		LargeImageSize:      *largeImageSize,
+		Progress:            *progress,
+		EventsJSON:          *eventsJSON,
+		DryRun:              *dryRun,
+		Serve:               serve,
+		Listen:              *listen,
+		BaseURL:             *baseURL,
+		Theme:               *theme,
+		IndexPageSize:       *indexPageSize,
+		IndexSort:           *indexSort,
+		IndexGroup:          *indexGroup,
+		Timeline:            *timeline,
+		MapTileURL:          *mapTileURL,
+		MapAttribution:      *mapAttribution,
+		SetFlags:            setFlags,
 	}, nil
 }
+
+// configure sets the gallery's settings. Those in the gallery file take
+// precedence over the defaults of our flags, and flags given on the command
+// line take precedence over both.
+//
+// The gallery keeps what we read, so loading it doesn't parse the gallery file
+// again.
+func configure(g *gallery.Gallery, args *Args) error {
+	config, err := gallery.ReadGalleryConfig(args.GalleryFile)
+	if err != nil {
+		return fmt.Errorf("unable to read gallery file: %s", err)
+	}
+
+	g.InstallDir = args.InstallDir
+	g.Name = args.Name
+	g.IncludeZips = args.IncludeZips
+	g.IncludeOriginals = args.IncludeOriginals
+	g.ConvertOriginals = args.ConvertOriginals
+	g.PageSize = args.PageSize
+	g.ThumbnailSize = args.ThumbnailSize
+	g.LargeImageSize = args.LargeImageSize
+	g.BaseURL = args.BaseURL
+	g.Theme = args.Theme
+	g.IndexPageSize = args.IndexPageSize
+	g.IndexSort = args.IndexSort
+	g.IndexGroup = args.IndexGroup
+	g.Timeline = args.Timeline
+	g.MapTileURL = args.MapTileURL
+	g.MapAttribution = args.MapAttribution
+
+	if args.SetFlags["install-dir"] {
+		config.InstallDir = nil
+	}
+	if args.SetFlags["title"] {
+		config.Name = nil
+	}
+	if args.SetFlags["include-zips"] {
+		config.IncludeZips = nil
+	}
+	if args.SetFlags["include-originals"] {
+		config.IncludeOriginals = nil
+	}
+	if args.SetFlags["convert-originals"] {
+		config.ConvertOriginals = nil
+	}
+	if args.SetFlags["page-size"] {
+		config.PageSize = nil
+	}
+	if args.SetFlags["thumbnail-size"] {
+		config.ThumbnailSize = nil
+	}
+	if args.SetFlags["large-image-size"] {
+		config.LargeImageSize = nil
+	}
+	if args.SetFlags["base-url"] {
+		config.BaseURL = nil
+	}
+	if args.SetFlags["theme"] {
+		config.Theme = nil
+	}
+	if args.SetFlags["index-page-size"] {
+		config.IndexPageSize = nil
+	}
+	if args.SetFlags["index-sort"] {
+		config.IndexSort = nil
+	}
+	if args.SetFlags["index-group"] {
+		config.IndexGroup = nil
+	}
+	if args.SetFlags["timeline"] {
+		config.Timeline = nil
+	}
+	if args.SetFlags["map-tile-url"] {
+		config.MapTileURL = nil
+	}
+	if args.SetFlags["map-attribution"] {
+		config.MapAttribution = nil
+	}
+
+	config.Apply(g)
+
+	return nil
+}
+
+// printPlan reports what installing the gallery would do.
+func printPlan(g *gallery.Gallery, verbose bool) error {
+	plan, err := g.Plan()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	for _, f := range plan.Files {
+		if f.Action == gallery.PlanKeep && !verbose {
+			continue
+		}
+
+		album := f.Album
+		if album == "" {
+			album = "(gallery)"
+		}
+
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", f.Action, album, f.Kind,
+			f.Path)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Would create %d, regenerate %d, and keep %d files.\n",
+		plan.Count(gallery.PlanCreate), plan.Count(gallery.PlanRegenerate),
+		plan.Count(gallery.PlanKeep))
+
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/horgh/gallery"
+)
+
+// progress follows the events from installing a gallery. It draws a progress
+// bar and gathers statistics about each album for a summary.
+type progress struct {
+	out io.Writer
+
+	// Whether to draw the progress bar.
+	showBar bool
+
+	start    time.Time
+	lastDraw time.Time
+
+	// Number of images in albums that have started, and the number we've
+	// finished with (generated, skipped, or failed).
+	totalImages int
+	doneImages  int
+
+	albums map[string]*albumStats
+}
+
+// albumStats holds what happened with one album.
+type albumStats struct {
+	name      string
+	images    int
+	generated int
+	skipped   int
+	failed    int
+	originals int
+	pages     int
+	zips      int
+	bytes     int64
+	duration  time.Duration
+	err       error
+}
+
+// How wide the progress bar is, in characters.
+const progressBarWidth = 30
+
+// How often we redraw the progress bar at most.
+const progressDrawInterval = 100 * time.Millisecond
+
+func newProgress(out io.Writer, showBar bool) *progress {
+	return &progress{
+		out:     out,
+		showBar: showBar,
+		start:   time.Now(),
+		albums:  map[string]*albumStats{},
+	}
+}
+
+// isTerminal tells us whether the file looks like a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// handle records an event. It is for use as Gallery.OnEvent.
+func (p *progress) handle(e gallery.Event) {
+	if e.Album != "" {
+		stats, ok := p.albums[e.Album]
+		if !ok {
+			stats = &albumStats{name: e.Album}
+			p.albums[e.Album] = stats
+		}
+
+		stats.bytes += e.Bytes
+
+		switch e.Type {
+		case gallery.EventAlbumStarted:
+			stats.images = e.Images
+			p.totalImages += e.Images
+		case gallery.EventAlbumFinished:
+			stats.duration = e.Duration
+			stats.err = e.Err
+		case gallery.EventImageGenerated:
+			stats.generated++
+			p.doneImages++
+		case gallery.EventImageSkipped:
+			stats.skipped++
+			p.doneImages++
+		case gallery.EventImageFailed:
+			stats.failed++
+			p.doneImages++
+		case gallery.EventOriginalInstalled:
+			stats.originals++
+		case gallery.EventPageWritten:
+			stats.pages++
+		case gallery.EventZipWritten:
+			stats.zips++
+		}
+	}
+
+	if p.showBar && time.Since(p.lastDraw) >= progressDrawInterval {
+		p.draw()
+		p.lastDraw = time.Now()
+	}
+}
+
+// draw redraws the progress bar.
+func (p *progress) draw() {
+	fraction := 0.0
+	if p.totalImages > 0 {
+		fraction = float64(p.doneImages) / float64(p.totalImages)
+	}
+
+	filled := int(fraction * progressBarWidth)
+	bar := strings.Repeat("=", filled) +
+		strings.Repeat(" ", progressBarWidth-filled)
+
+	eta := "?"
+	if p.doneImages > 0 {
+		elapsed := time.Since(p.start)
+		remaining := time.Duration(float64(elapsed) / float64(p.doneImages) *
+			float64(p.totalImages-p.doneImages))
+		eta = remaining.Round(time.Second).String()
+	}
+
+	_, _ = fmt.Fprintf(p.out, "\r[%s] %d/%d images, ETA %s\033[K", bar,
+		p.doneImages, p.totalImages, eta)
+}
+
+// finish clears the progress bar and writes a summary of each album. We only
+// do so if we're showing the progress bar. Otherwise we stay quiet, such as
+// when run from cron.
+func (p *progress) finish() {
+	if !p.showBar {
+		return
+	}
+
+	_, _ = fmt.Fprint(p.out, "\r\033[K")
+
+	var albums []*albumStats
+	for _, stats := range p.albums {
+		albums = append(albums, stats)
+	}
+	sort.Slice(albums, func(i, j int) bool {
+		return albums[i].name < albums[j].name
+	})
+
+	w := tabwriter.NewWriter(p.out, 0, 0, 2, ' ', 0)
+
+	_, _ = fmt.Fprintln(w,
+		"Album\tImages\tGenerated\tSkipped\tFailed\tOriginals\tPages\tZips\tWritten\tTime\t")
+
+	for _, s := range albums {
+		status := s.duration.Round(time.Millisecond).String()
+		if s.err != nil {
+			status = "failed"
+		}
+
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t\n",
+			s.name, s.images, s.generated, s.skipped, s.failed, s.originals,
+			s.pages, s.zips, formatBytes(s.bytes), status)
+	}
+
+	_ = w.Flush()
+
+	_, _ = fmt.Fprintf(p.out, "Done in %s.\n",
+		time.Since(p.start).Round(time.Millisecond))
+}
+
+// formatBytes formats a byte count for people.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/gallery"
+)
+
+// How often we check for changes to the files the gallery is built from.
+const watchInterval = time.Second
+
+// The path the browser listens for reload notifications on.
+const liveReloadPath = "/_livereload"
+
+// liveReloadScript reloads the page when we tell it to. We add it to every
+// HTML page we serve.
+const liveReloadScript = `
+<script>
+new EventSource("` + liveReloadPath + `").onmessage = function() {
+	window.location.reload();
+};
+</script>
+`
+
+// fileState is what we compare to tell whether a file changed.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// reloader tells connected browsers to reload.
+type reloader struct {
+	mutex   sync.Mutex
+	clients map[chan struct{}]struct{}
+}
+
+// previewHandler serves the built gallery, adding the live reload script to
+// HTML pages.
+type previewHandler struct {
+	dir      string
+	files    http.Handler
+	reloader *reloader
+}
+
+// serve builds the gallery, serves it over HTTP, and rebuilds it when the
+// files it is built from change.
+//
+// If the gallery file changes, we call reconfigure to apply its settings
+// before rebuilding.
+func serve(ctx context.Context, g *gallery.Gallery, listen string,
+	reconfigure func() error) error {
+	log.Printf("Building gallery in %s...", g.InstallDir)
+
+	if err := g.Install(ctx); err != nil {
+		return fmt.Errorf("unable to install gallery: %s", err)
+	}
+
+	reloader := &reloader{clients: map[chan struct{}]struct{}{}}
+
+	server := &http.Server{
+		Addr: listen,
+		Handler: &previewHandler{
+			dir:      g.InstallDir,
+			files:    http.FileServer(http.Dir(g.InstallDir)),
+			reloader: reloader,
+		},
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	log.Printf("Serving gallery at http://%s/", listen)
+
+	state := scanPaths(g.WatchPaths())
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			_ = server.Close()
+			return nil
+		case err := <-serverErr:
+			return err
+		case <-ticker.C:
+		}
+
+		newState := scanPaths(g.WatchPaths())
+		changed := changedPaths(state, newState)
+		state = newState
+		if len(changed) == 0 {
+			continue
+		}
+
+		for _, path := range changed {
+			log.Printf("Changed: %s", path)
+		}
+
+		for _, path := range changed {
+			if !g.IsGalleryFile(path) {
+				continue
+			}
+
+			if err := reconfigure(); err != nil {
+				log.Printf("Unable to configure gallery: %s", err)
+			}
+			break
+		}
+
+		start := time.Now()
+		if err := g.Rebuild(ctx, changed); err != nil {
+			// Keep watching. Presumably there will be a fix.
+			log.Printf("Unable to rebuild gallery: %s", err)
+			continue
+		}
+		log.Printf("Rebuilt in %s", time.Since(start).Round(time.Millisecond))
+
+		// The gallery file may list different albums now.
+		state = scanPaths(g.WatchPaths())
+
+		reloader.notify()
+	}
+}
+
+// scanPaths records the state of the given files and directories. For
+// directories we record the state of the files in them, and which directories
+// they have. This way we see when a new album directory appears.
+func scanPaths(paths []string) map[string]fileState {
+	state := map[string]fileState{}
+
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+
+		if !fi.IsDir() {
+			state[p] = fileState{modTime: fi.ModTime(), size: fi.Size()}
+			continue
+		}
+
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				state[filepath.Join(p, entry.Name())] = fileState{}
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+
+			state[filepath.Join(p, entry.Name())] = fileState{
+				modTime: info.ModTime(),
+				size:    info.Size(),
+			}
+		}
+	}
+
+	return state
+}
+
+// changedPaths returns the paths that were added, removed, or changed between
+// the two states.
+func changedPaths(before, after map[string]fileState) []string {
+	var changed []string
+
+	for p, state := range after {
+		if old, ok := before[p]; !ok || old != state {
+			changed = append(changed, p)
+		}
+	}
+
+	for p := range before {
+		if _, ok := after[p]; !ok {
+			changed = append(changed, p)
+		}
+	}
+
+	sort.Strings(changed)
+
+	return changed
+}
+
+func (h *previewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == liveReloadPath {
+		h.reloader.ServeHTTP(w, r)
+		return
+	}
+
+	urlPath := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") {
+		urlPath = path.Join(urlPath, "index.html")
+	}
+
+	if !strings.HasSuffix(urlPath, ".html") {
+		h.files.ServeHTTP(w, r)
+		return
+	}
+
+	buf, err := os.ReadFile(filepath.Join(h.dir, filepath.FromSlash(urlPath)))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	_, _ = w.Write(buf)
+	_, _ = w.Write([]byte(liveReloadScript))
+}
+
+// ServeHTTP sends a server-sent event each time we rebuild.
+func (rl *reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	flusher.Flush()
+
+	ch := make(chan struct{}, 1)
+
+	rl.mutex.Lock()
+	rl.clients[ch] = struct{}{}
+	rl.mutex.Unlock()
+
+	defer func() {
+		rl.mutex.Lock()
+		delete(rl.clients, ch)
+		rl.mutex.Unlock()
+	}()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ch:
+			if _, err := fmt.Fprint(w, "data: reload\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// notify tells all connected browsers to reload.
+func (rl *reloader) notify() {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	for ch := range rl.clients {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package gallery
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tiffRawFormats are the RAW formats (by extension) that are TIFF files. We
+// can't tell them apart from their content alone.
+var tiffRawFormats = map[string]bool{
+	"dng": true,
+	"cr2": true,
+	"nef": true,
+	"nrw": true,
+	"arw": true,
+	"pef": true,
+	"srw": true,
+}
+
+// heifBrands are the ISO base media file brands of HEIC/HEIF images.
+var heifBrands = map[string]string{
+	"heic": "heic",
+	"heix": "heic",
+	"heim": "heic",
+	"heis": "heic",
+	"hevc": "heic",
+	"hevx": "heic",
+	"mif1": "heif",
+	"msf1": "heif",
+}
+
+// DetectImageFormat looks at the start of a file to tell what image format it
+// is in. We return the format as a lowercase file extension, such as jpg, png,
+// or heic. If the file is not in a format we support, we return a blank
+// string.
+//
+// We look at the content rather than trusting the file's extension. The
+// exception is TIFF based RAW formats, which look alike. For those we use the
+// extension to tell which it is.
+func DetectImageFormat(path string) (string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	header := make([]byte, 16)
+	n, err := io.ReadFull(fh, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		_ = fh.Close()
+		return "", fmt.Errorf("unable to read: %s: %s", path, err)
+	}
+	header = header[:n]
+
+	if err := fh.Close(); err != nil {
+		return "", fmt.Errorf("close: %s", err)
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+
+	return detectFormat(header, ext), nil
+}
+
+// detectFormat decides the format from the first bytes of a file.
+func detectFormat(header []byte, ext string) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("\xff\xd8\xff")):
+		return "jpg"
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(header, []byte("GIF87a")),
+		bytes.HasPrefix(header, []byte("GIF89a")):
+		return "gif"
+	case len(header) >= 12 && bytes.Equal(header[:4], []byte("RIFF")) &&
+		bytes.Equal(header[8:12], []byte("WEBP")):
+		return "webp"
+	case bytes.HasPrefix(header, []byte("FUJIFILMCCD-RAW")):
+		return "raf"
+	case bytes.HasPrefix(header, []byte("IIRO")),
+		bytes.HasPrefix(header, []byte("IIRS")),
+		bytes.HasPrefix(header, []byte("MMOR")):
+		return "orf"
+	case bytes.HasPrefix(header, []byte("IIU\x00")):
+		return "rw2"
+	case bytes.HasPrefix(header, []byte("II*\x00")),
+		bytes.HasPrefix(header, []byte("MM\x00*")):
+		if tiffRawFormats[ext] {
+			return ext
+		}
+		return ""
+	case len(header) >= 12 && bytes.Equal(header[4:8], []byte("ftyp")):
+		brand := string(header[8:12])
+		if brand == "crx " {
+			return "cr3"
+		}
+		return heifBrands[brand]
+	default:
+		return ""
+	}
+}
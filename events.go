@@ -0,0 +1,153 @@
+package gallery
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// EventType says what happened in an Event.
+type EventType int
+
+// The types of Event.
+const (
+	// We're starting to install an album. Images is the number of images we
+	// chose for it.
+	EventAlbumStarted EventType = iota
+
+	// We finished installing an album. Err is set if it failed.
+	EventAlbumFinished
+
+	// We created resized versions of an image. Path is the original.
+	EventImageGenerated
+
+	// All resized versions of an image exist already. Path is the original.
+	EventImageSkipped
+
+	// We failed to create resized versions of an image. Path is the original.
+	EventImageFailed
+
+	// We copied (or converted) an original image. Path is the installed copy.
+	EventOriginalInstalled
+
+	// We wrote an HTML page.
+	EventPageWritten
+
+	// We wrote an album's zip file.
+	EventZipWritten
+)
+
+// Event describes something that happened while installing a gallery or
+// album.
+type Event struct {
+	Type EventType
+
+	// Name of the album. Blank for events about the gallery as a whole, such as
+	// writing its index page.
+	Album string
+
+	// Path to the file the event is about, if any.
+	Path string
+
+	// Number of images. Only set for EventAlbumStarted.
+	Images int
+
+	// How long the work took. Not set for skipped work.
+	Duration time.Duration
+
+	// Number of bytes we wrote.
+	Bytes int64
+
+	// Set if the work failed.
+	Err error
+}
+
+func (t EventType) String() string {
+	switch t {
+	case EventAlbumStarted:
+		return "album started"
+	case EventAlbumFinished:
+		return "album finished"
+	case EventImageGenerated:
+		return "image generated"
+	case EventImageSkipped:
+		return "image skipped"
+	case EventImageFailed:
+		return "image failed"
+	case EventOriginalInstalled:
+		return "original installed"
+	case EventPageWritten:
+		return "page written"
+	case EventZipWritten:
+		return "zip written"
+	default:
+		return "unknown"
+	}
+}
+
+// SlogEventHandler returns an event handler (for Gallery.OnEvent or
+// Album.OnEvent) that logs each event to the given logger.
+//
+// Failures log at error level, finished work at info level, and skipped work
+// at debug level.
+func SlogEventHandler(logger *slog.Logger) func(Event) {
+	return func(e Event) {
+		level := slog.LevelInfo
+		if e.Type == EventImageSkipped {
+			level = slog.LevelDebug
+		}
+
+		attrs := []slog.Attr{slog.String("type", e.Type.String())}
+		if e.Album != "" {
+			attrs = append(attrs, slog.String("album", e.Album))
+		}
+		if e.Path != "" {
+			attrs = append(attrs, slog.String("path", e.Path))
+		}
+		if e.Type == EventAlbumStarted {
+			attrs = append(attrs, slog.Int("images", e.Images))
+		}
+		if e.Duration > 0 {
+			attrs = append(attrs, slog.Duration("duration", e.Duration))
+		}
+		if e.Bytes > 0 {
+			attrs = append(attrs, slog.Int64("bytes", e.Bytes))
+		}
+		if e.Err != nil {
+			level = slog.LevelError
+			attrs = append(attrs, slog.String("error", e.Err.Error()))
+		}
+
+		logger.LogAttrs(context.Background(), level, e.Type.String(), attrs...)
+	}
+}
+
+// syncEventHandler wraps an event handler so that it is never called
+// concurrently. This way handlers don't need to worry about it even though
+// events come from many goroutines.
+//
+// If the handler is nil, we return nil.
+func syncEventHandler(f func(Event)) func(Event) {
+	if f == nil {
+		return nil
+	}
+
+	var mutex sync.Mutex
+	return func(e Event) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		f(e)
+	}
+}
+
+// fileSize returns the size of the file, or 0 if we can't tell. It is for
+// reporting only.
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
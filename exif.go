@@ -0,0 +1,451 @@
+package gallery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// exifData holds the EXIF fields we use.
+type exifData struct {
+	// Orientation as defined by EXIF. 1 is normal. 0 if not present.
+	Orientation int
+
+	// Time the image was taken. Zero if not present.
+	Time time.Time
+
+	// ImageDescription. Blank if not present.
+	Description string
+
+	// Where the image was taken. nil if not present.
+	Location *Location
+}
+
+// EXIF tags we look at.
+const (
+	exifTagImageDescription   = 0x010e
+	exifTagOrientation        = 0x0112
+	exifTagDateTime           = 0x0132
+	exifTagExifIFD            = 0x8769
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTimeOriginal = 0x9011
+	exifTagGPSIFD             = 0x8825
+)
+
+// GPS tags we look at. These are in the GPS IFD.
+const (
+	gpsTagLatitudeRef  = 0x0001
+	gpsTagLatitude     = 0x0002
+	gpsTagLongitudeRef = 0x0003
+	gpsTagLongitude    = 0x0004
+)
+
+// exifTimeLayout is the format of EXIF date/time fields.
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// maxTIFFRead is how much of a TIFF based file we read looking for metadata.
+const maxTIFFRead = 8 * 1024 * 1024
+
+// ifdEntry is a single field from a TIFF image file directory.
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// readExif reads EXIF data from the image at the given path.
+//
+// We understand JPEG files (EXIF in an APP1 segment) and TIFF based files,
+// which includes many RAW formats.
+//
+// If the file has no EXIF data, we return an empty exifData and no error.
+func readExif(path string) (*exifData, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tiff, err := findTIFF(fh)
+	if err != nil {
+		_ = fh.Close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if err := fh.Close(); err != nil {
+		return nil, fmt.Errorf("close: %s", err)
+	}
+
+	if tiff == nil {
+		return &exifData{}, nil
+	}
+
+	return parseExif(tiff)
+}
+
+// findTIFF finds the TIFF structure holding EXIF data in a file. It returns
+// nil if there is none.
+func findTIFF(r io.Reader) ([]byte, error) {
+	br := &byteReader{r: r}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// TIFF based files, such as many RAW formats, are themselves the TIFF
+	// structure. The metadata is near the start, so don't read all of what may
+	// be a very large file.
+	if bytes.Equal(header, []byte("II*\x00")) ||
+		bytes.Equal(header, []byte("MM\x00*")) {
+		rest, err := io.ReadAll(io.LimitReader(r, maxTIFFRead))
+		if err != nil {
+			return nil, err
+		}
+		return append(header, rest...), nil
+	}
+
+	// Otherwise we expect a JPEG.
+	if header[0] != 0xff || header[1] != 0xd8 {
+		return nil, nil
+	}
+
+	// We read the first marker of the JPEG along with the header.
+	marker := header[3]
+	for {
+		// SOS. Image data follows. There won't be EXIF after this.
+		if marker == 0xda || marker == 0xd9 {
+			return nil, nil
+		}
+
+		length, err := br.uint16()
+		if err != nil {
+			return nil, err
+		}
+		if length < 2 {
+			return nil, fmt.Errorf("invalid JPEG segment length")
+		}
+
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, err
+		}
+
+		// APP1.
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+
+		m, err := br.marker()
+		if err != nil {
+			return nil, err
+		}
+		marker = m
+	}
+}
+
+// parseExif parses the fields we want out of a TIFF structure.
+func parseExif(tiff []byte) (*exifData, error) {
+	if len(tiff) < 8 {
+		return nil, fmt.Errorf("TIFF header too short")
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid TIFF byte order")
+	}
+
+	ifd0, err := readIFD(tiff, order, order.Uint32(tiff[4:8]))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read IFD0: %s", err)
+	}
+
+	data := &exifData{}
+
+	if e, ok := ifd0[exifTagOrientation]; ok {
+		data.Orientation = int(e.uint(order, 0))
+	}
+
+	if e, ok := ifd0[exifTagImageDescription]; ok {
+		data.Description = e.string()
+	}
+
+	// DateTime is when the file was last changed. We use it only if there is
+	// no DateTimeOriginal, which is when the image was taken.
+	if e, ok := ifd0[exifTagDateTime]; ok {
+		data.Time = parseExifTime(e.string(), "")
+	}
+
+	if e, ok := ifd0[exifTagExifIFD]; ok {
+		// Not all files have a valid Exif IFD. We still have what's in IFD0.
+		exifIFD, err := readIFD(tiff, order, e.uint(order, 0))
+		if err == nil {
+			if e, ok := exifIFD[exifTagDateTimeOriginal]; ok {
+				offset := ""
+				if o, ok := exifIFD[exifTagOffsetTimeOriginal]; ok {
+					offset = o.string()
+				}
+
+				if t := parseExifTime(e.string(), offset); !t.IsZero() {
+					data.Time = t
+				}
+			}
+		}
+	}
+
+	if e, ok := ifd0[exifTagGPSIFD]; ok {
+		// As with the Exif IFD, a broken GPS IFD doesn't stop us.
+		gpsIFD, err := readIFD(tiff, order, e.uint(order, 0))
+		if err == nil {
+			data.Location = parseGPS(gpsIFD, order)
+		}
+	}
+
+	return data, nil
+}
+
+// parseGPS finds the location in a GPS IFD. It returns nil if there is none.
+func parseGPS(ifd map[uint16]ifdEntry, order binary.ByteOrder) *Location {
+	lat, ok := gpsCoordinate(ifd, order, gpsTagLatitude, gpsTagLatitudeRef, "S")
+	if !ok {
+		return nil
+	}
+
+	lon, ok := gpsCoordinate(ifd, order, gpsTagLongitude, gpsTagLongitudeRef,
+		"W")
+	if !ok {
+		return nil
+	}
+
+	location := &Location{Latitude: lat, Longitude: lon}
+	if !location.valid() {
+		return nil
+	}
+
+	return location
+}
+
+// gpsCoordinate reads a latitude or longitude. It is stored as degrees,
+// minutes, and seconds, along with a reference saying which hemisphere it is
+// in. negative is the reference for the negative one.
+func gpsCoordinate(ifd map[uint16]ifdEntry, order binary.ByteOrder, tag,
+	refTag uint16, negative string) (float64, bool) {
+	e, ok := ifd[tag]
+	if !ok || e.typ != 5 || e.count != 3 {
+		return 0, false
+	}
+
+	degrees, ok1 := e.rational(order, 0)
+	minutes, ok2 := e.rational(order, 1)
+	seconds, ok3 := e.rational(order, 2)
+	if !ok1 || !ok2 || !ok3 {
+		return 0, false
+	}
+
+	value := degrees + minutes/60 + seconds/3600
+
+	if ref, ok := ifd[refTag]; ok && ref.string() == negative {
+		value = -value
+	}
+
+	return value, true
+}
+
+// parseExifTime parses an EXIF date/time and optional offset from UTC (such
+// as +09:00). Without an offset we assume the time is in the local time zone.
+// We return a zero time if it is not valid.
+func parseExifTime(value, offset string) time.Time {
+	location := time.Local
+	if offset != "" {
+		t, err := time.Parse("-07:00", offset)
+		if err == nil {
+			location = t.Location()
+		}
+	}
+
+	t, err := time.ParseInLocation(exifTimeLayout, value, location)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return t
+}
+
+// CaptureTime returns the time the image at the given path was taken,
+// according to its EXIF data. If we can't find out, we return a zero time.
+func CaptureTime(path string) (time.Time, error) {
+	data, err := readExif(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return data.Time, nil
+}
+
+// ImageTime returns when the image at the given path was taken. If it doesn't
+// say, we use its modification time. We return a zero time if we can't tell
+// either, such as if the image doesn't exist.
+func ImageTime(path string) time.Time {
+	t, err := CaptureTime(path)
+	if err == nil && !t.IsZero() {
+		return t
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return fi.ModTime()
+}
+
+// readIFD reads the image file directory at the given offset.
+func readIFD(tiff []byte, order binary.ByteOrder,
+	offset uint32) (map[uint16]ifdEntry, error) {
+	if int64(offset)+2 > int64(len(tiff)) {
+		return nil, fmt.Errorf("IFD offset out of range")
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+	pos := int(offset) + 2
+	if pos+count*12 > len(tiff) {
+		return nil, fmt.Errorf("IFD entries out of range")
+	}
+
+	entries := map[uint16]ifdEntry{}
+
+	for i := 0; i < count; i++ {
+		raw := tiff[pos+i*12 : pos+i*12+12]
+
+		e := ifdEntry{
+			typ:   order.Uint16(raw[2:4]),
+			count: order.Uint32(raw[4:8]),
+		}
+
+		size := ifdTypeSize(e.typ) * int64(e.count)
+		if size == 0 {
+			continue
+		}
+
+		// Values of up to 4 bytes are stored in the entry itself. Otherwise the
+		// entry holds an offset to them.
+		if size <= 4 {
+			e.value = raw[8 : 8+size]
+		} else {
+			valueOffset := int64(order.Uint32(raw[8:12]))
+			if valueOffset+size > int64(len(tiff)) {
+				continue
+			}
+			e.value = tiff[valueOffset : valueOffset+size]
+		}
+
+		entries[order.Uint16(raw[0:2])] = e
+	}
+
+	return entries, nil
+}
+
+// ifdTypeSize returns the size in bytes of a single value of the given TIFF
+// field type. It returns 0 for types we don't know.
+func ifdTypeSize(typ uint16) int64 {
+	switch typ {
+	case 1, 2, 6, 7: // BYTE, ASCII, SBYTE, UNDEFINED
+		return 1
+	case 3, 8: // SHORT, SSHORT
+		return 2
+	case 4, 9, 11: // LONG, SLONG, FLOAT
+		return 4
+	case 5, 10, 12: // RATIONAL, SRATIONAL, DOUBLE
+		return 8
+	default:
+		return 0
+	}
+}
+
+// uint returns the i'th value of a BYTE, SHORT, or LONG field.
+func (e ifdEntry) uint(order binary.ByteOrder, i int) uint32 {
+	switch e.typ {
+	case 1, 7:
+		if i < len(e.value) {
+			return uint32(e.value[i])
+		}
+	case 3:
+		if (i+1)*2 <= len(e.value) {
+			return uint32(order.Uint16(e.value[i*2:]))
+		}
+	case 4:
+		if (i+1)*4 <= len(e.value) {
+			return order.Uint32(e.value[i*4:])
+		}
+	}
+	return 0
+}
+
+// rational returns the i'th value of a RATIONAL field. It returns false if
+// there is no such value or it is not valid.
+func (e ifdEntry) rational(order binary.ByteOrder, i int) (float64, bool) {
+	if e.typ != 5 || (i+1)*8 > len(e.value) {
+		return 0, false
+	}
+
+	num := order.Uint32(e.value[i*8:])
+	denom := order.Uint32(e.value[i*8+4:])
+	if denom == 0 {
+		return 0, false
+	}
+
+	return float64(num) / float64(denom), true
+}
+
+// string returns the value of an ASCII field.
+func (e ifdEntry) string() string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+// byteReader reads the pieces of a JPEG we need to walk its segments.
+type byteReader struct {
+	r io.Reader
+}
+
+func (b *byteReader) uint16() (uint16, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(b.r, buf); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(buf), nil
+}
+
+// marker reads the next JPEG marker, skipping any fill bytes.
+func (b *byteReader) marker() (byte, error) {
+	buf := make([]byte, 1)
+
+	if _, err := io.ReadFull(b.r, buf); err != nil {
+		return 0, err
+	}
+	if buf[0] != 0xff {
+		return 0, fmt.Errorf("expected JPEG marker")
+	}
+
+	for {
+		if _, err := io.ReadFull(b.r, buf); err != nil {
+			return 0, err
+		}
+		if buf[0] != 0xff {
+			return buf[0], nil
+		}
+	}
+}
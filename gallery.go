@@ -1,17 +1,22 @@
 package gallery
 
 import (
-	"bufio"
+	"context"
 	"fmt"
-	"os"
+	"log"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Gallery holds information about a full gallery site which contains 1 or
 // more albums of images.
 type Gallery struct {
-	// File describing the gallery and its albums.
+	// File describing the gallery and its albums. We don't apply gallery-wide
+	// settings in it to the fields here. See ReadGalleryConfig().
 	File string
 
 	// Directory where we output including images and HTML.
@@ -29,6 +34,9 @@ type Gallery struct {
 	// See description of this option in Album.
 	IncludeOriginals bool
 
+	// See description of this option in Album.
+	ConvertOriginals bool
+
 	// Force generation of images (e.g. thumbs) even if they exist.
 	ForceGenerateImages bool
 
@@ -41,197 +49,676 @@ type Gallery struct {
 	// Number of image thumbnails per page in albums.
 	PageSize int
 
-	// Number of workers to use in resizing images.
+	// See definition in Album.
 	Workers int
 
+	// See definition in Album.
+	MemoryBudget int64
+
+	// See definition in Album.
+	Processor ImageProcessor
+
 	// See definition in Album.
 	ThumbnailSize int
 
 	// See definition in Album.
 	LargeImageSize int
 
+	// URL the gallery is published at, such as https://example.com/gallery.
+	// If set, pages say what their URL is. Optional.
+	BaseURL string
+
+	// See definition in Album.
+	Theme string
+
+	// Number of albums per page on the gallery index. 0 means all of them on
+	// one page.
+	IndexPageSize int
+
+	// How to order albums on the gallery index. One of:
+	//
+	// file: The order of the gallery file.
+	// name: By name.
+	// newest: By when their newest image was taken, newest first.
+	//
+	// Blank means file.
+	IndexSort string
+
+	// How to group albums into sections on the gallery index. One of:
+	//
+	// year: By the year their newest image was taken, newest first.
+	// group: By the albums' Group. Sections are in the order their first album
+	// is.
+	//
+	// Blank means no sections.
+	IndexGroup string
+
+	// If true, we make pages showing the images of all albums by when they
+	// were taken. There is a page for each month and year, and a calendar of
+	// all years linking to them.
+	Timeline bool
+
+	// URL template for map tiles. {z}, {x}, and {y} are replaced by the zoom
+	// level and tile coordinates. Blank means OpenStreetMap's. Use this to
+	// load tiles from your own tile server. Albums only have maps if they ask
+	// for one (album-map in the gallery file).
+	MapTileURL string
+
+	// Attribution for the map tiles, such as their copyright. Blank means
+	// OpenStreetMap's if MapTileURL is blank.
+	MapAttribution string
+
+	// OnEvent, if set, is called as we make progress installing the gallery.
+	// It receives events from all albums. We never call it concurrently. See
+	// SlogEventHandler() for logging events with log/slog.
+	OnEvent func(Event)
+
 	// Albums in the gallery.
 	albums []*Album
+
+	// The gallery file and those it includes.
+	files []string
+
+	// The album-glob blocks of the gallery file. We watch for directories
+	// matching them. See WatchPaths().
+	globs []*albumBlock
+
+	// The gallery file as ReadGalleryConfig() read it. The next load uses this
+	// rather than reading the file again.
+	parsed *galleryFile
 }
 
 // Install loads gallery/albums information. It then resizes the images as
 // needed, and generates and installs the HTML/images.
-func (g *Gallery) Install() error {
+//
+// If the context is cancelled, we stop starting new work and return once
+// running work finishes. We write files atomically, so an interrupted install
+// leaves no partial files.
+func (g *Gallery) Install(ctx context.Context) error {
 	err := g.load(g.File)
 	if err != nil {
 		return fmt.Errorf("unable to load gallery file: %s", err)
 	}
 
-	err = makeDirIfNotExist(g.InstallDir)
+	return g.install(ctx, g.ForceGenerateHTML)
+}
+
+// Load loads gallery/albums information, including which images each album
+// has. It does not install anything.
+//
+// Install() loads the gallery itself. This is for when you want to look at it
+// without installing it.
+func (g *Gallery) Load() error {
+	if err := g.load(g.File); err != nil {
+		return fmt.Errorf("unable to load gallery file: %s", err)
+	}
+
+	for _, album := range g.albums {
+		if err := album.load(); err != nil {
+			return fmt.Errorf("unable to parse metadata file: %s: %s", album.Name,
+				err)
+		}
+
+		if err := album.ChooseImages(); err != nil {
+			return fmt.Errorf("unable to choose images: %s: %s", album.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Albums returns the gallery's albums. The gallery must be loaded, such as by
+// Load().
+func (g *Gallery) Albums() []*Album {
+	return g.albums
+}
+
+// install installs the loaded albums and then the gallery index page.
+func (g *Gallery) install(ctx context.Context, forceIndex bool) error {
+	err := makeDirIfNotExist(g.InstallDir)
 	if err != nil {
 		return err
 	}
 
-	htmlAlbums := []HTMLAlbum{}
+	// Albums install concurrently. They share one scheduler so that jobs from
+	// different albums (resizing, copying, zipping) run in a single pool.
+	sched := newScheduler(g.Workers, g.MemoryBudget)
+	logs := newOrderedLog(log.Writer(), len(g.albums))
+	errs := make([]error, len(g.albums))
+	events := syncEventHandler(g.OnEvent)
+
+	wg := sync.WaitGroup{}
+
+	for i, album := range g.albums {
+		album.sched = sched
+		album.logger = logs.logger(i)
+		album.events = events
+
+		wg.Add(1)
+		go func(i int, album *Album) {
+			defer wg.Done()
+			errs[i] = album.Install(ctx)
+			logs.finish(i)
+		}(i, album)
+	}
 
-	for _, album := range g.albums {
-		err := album.Install()
-		if err != nil {
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Whether an album was protected or unprotected. The index, timeline, and
+	// map may show images of an album that is now protected.
+	relocked := false
+
+	for i, album := range g.albums {
+		if errs[i] != nil {
 			return fmt.Errorf("unable to install album: %s: %s", album.Name,
-				err)
+				errs[i])
 		}
 
-		htmlAlbums = append(htmlAlbums, HTMLAlbum{
-			URL: fmt.Sprintf("%s/index.html", album.InstallSubDir),
-			ThumbURL: fmt.Sprintf("%s/%s", album.InstallSubDir,
-				album.GetThumb().ThumbnailFilename),
-			Name: album.Name,
-		})
+		if album.relock {
+			relocked = true
+			forceIndex = true
+		}
 	}
 
-	err = makeGalleryHTML(g.InstallDir, g.Name, htmlAlbums, g.Verbose,
-		g.ForceGenerateHTML)
+	pages, err := g.indexPages()
 	if err != nil {
-		return fmt.Errorf("unable to make gallery HTML: %s", err)
+		return err
 	}
 
-	return nil
-}
-
-// load a gallery's information from a gallery file.
-//
-// Format of the gallery file: It is made of blocks that look like this:
-//
-// album-name   = Name/title of an album. Human readable.
-// album-dir    = Path to the directory containing the album's original images.
-// album-subdir = A name for the album suitable as a directory name. Not
-//                absolute. We install images here and store them here in a
-//                subdir to avoid collisions with other albums.
-// album-file   = Path to a file describing the album's images.
-// album-tags   = Comma separated list of tags to use to decide what images
-//                from the album to include. If this is empty then we include
-//                all images.
-func (g *Gallery) load(file string) error {
-	fh, err := os.Open(file)
+	style, err := themeCSS(g.Theme)
 	if err != nil {
 		return err
 	}
 
-	scanner := bufio.NewScanner(fh)
+	onWritten := func(path string, start time.Time) {
+		if events == nil {
+			return
+		}
+		events(Event{
+			Type:     EventPageWritten,
+			Path:     path,
+			Duration: time.Since(start),
+			Bytes:    fileSize(path),
+		})
+	}
 
-	albumName := ""
-	albumSubDir := ""
-	albumDir := ""
-	albumFile := ""
-	albumTags := ""
+	timelineURL := ""
+	if g.Timeline {
+		timelineURL = timelineDir + "/index.html"
 
-	for scanner.Scan() {
-		text := strings.TrimSpace(scanner.Text())
-		if len(text) == 0 {
-			continue
+		if err := g.installTimeline(style, forceIndex, onWritten); err != nil {
+			return fmt.Errorf("unable to make timeline: %s", err)
 		}
+	}
 
-		if text[0] == '#' {
-			continue
+	mapURL := ""
+	if features := g.mapFeatures(); features != nil {
+		if len(features) > 0 {
+			mapURL = mapPageFilename
 		}
 
-		pieces := strings.SplitN(text, "=", 2)
-		if len(pieces) != 2 {
-			_ = fh.Close()
-			return fmt.Errorf("malformed line: %s", text)
+		start := time.Now()
+		written, err := makeMapHTML(g.InstallDir, mapPage{
+			Title:       g.Name,
+			BackURL:     "index.html",
+			BackName:    g.Name,
+			Features:    features,
+			TileURL:     mapTileURL(g.MapTileURL),
+			Attribution: mapAttribution(g.MapTileURL, g.MapAttribution),
+		}, style, g.BaseURL, log.Default(), g.Verbose, forceIndex)
+		if err != nil {
+			return fmt.Errorf("unable to make map: %s", err)
+		}
+		if written {
+			onWritten(filepath.Join(g.InstallDir, mapPageFilename), start)
 		}
+	} else if relocked {
+		if err := removeMapHTML(g.InstallDir); err != nil {
+			return err
+		}
+	}
 
-		pieces[0] = strings.TrimSpace(pieces[0])
-		pieces[1] = strings.TrimSpace(pieces[1])
+	for i, groups := range pages {
+		page := i + 1
 
-		if pieces[0] == "album-name" {
-			if len(albumName) > 0 {
-				err := g.loadAlbum(albumName, albumDir, albumSubDir, albumFile,
-					albumTags)
-				if err != nil {
-					_ = fh.Close()
-					return err
-				}
-			}
+		start := time.Now()
+		written, err := makeGalleryHTML(g.InstallDir, g.Name, groups, len(pages),
+			page, timelineURL, mapURL, style, g.BaseURL, log.Default(), g.Verbose,
+			forceIndex)
+		if err != nil {
+			return fmt.Errorf("unable to make gallery HTML: %s", err)
+		}
 
-			albumName = pieces[1]
-			continue
+		if written {
+			onWritten(filepath.Join(g.InstallDir, albumPageFilename(page)), start)
 		}
+	}
 
-		if pieces[0] == "album-dir" {
-			albumDir = pieces[1]
-			continue
+	if forceIndex {
+		if err := removePagesAfter(g.InstallDir, len(pages)); err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
 
-		if pieces[0] == "album-subdir" {
-			albumSubDir = pieces[1]
+// mapFeatures returns the images for the gallery's map. These are from the
+// albums with maps. We return nil if there are none of those.
+func (g *Gallery) mapFeatures() []geoJSONFeature {
+	var features []geoJSONFeature
+
+	for _, album := range g.albums {
+		if !album.showMap() {
 			continue
 		}
 
-		if pieces[0] == "album-file" {
-			albumFile = pieces[1]
-			continue
+		if features == nil {
+			features = []geoJSONFeature{}
+		}
+
+		features = append(features,
+			album.mapFeatures(album.InstallSubDir+"/")...)
+	}
+
+	return features
+}
+
+// indexAlbum is an album as the gallery index shows it.
+type indexAlbum struct {
+	html   HTMLAlbum
+	group  string
+	newest time.Time
+}
+
+// indexSorts are the values IndexSort may have.
+var indexSorts = []string{"file", "name", "newest"}
+
+// indexGroups are the values IndexGroup may have, other than blank.
+var indexGroups = []string{"year", "group"}
+
+// CheckIndexSort tells us whether the value is one IndexSort may have.
+func CheckIndexSort(value string) error {
+	if value == "" || contains(indexSorts, value) {
+		return nil
+	}
+	return fmt.Errorf("index sort must be %s: %s", orList(indexSorts), value)
+}
+
+// CheckIndexGroup tells us whether the value is one IndexGroup may have.
+func CheckIndexGroup(value string) error {
+	if value == "" || contains(indexGroups, value) {
+		return nil
+	}
+	return fmt.Errorf("index group must be %s: %s", orList(indexGroups), value)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
 		}
+	}
+	return false
+}
 
-		if pieces[0] == "album-tags" {
-			albumTags = pieces[1]
+// orList joins the values like "a, b, or c".
+func orList(values []string) string {
+	if len(values) < 3 {
+		return strings.Join(values, " or ")
+	}
+	return strings.Join(values[:len(values)-1], ", ") + ", or " +
+		values[len(values)-1]
+}
+
+// indexPages orders and groups the albums for the gallery index, and splits
+// them into pages. We leave out albums without images. The albums' images
+// must have been chosen.
+func (g *Gallery) indexPages() ([][]HTMLAlbumGroup, error) {
+	if err := CheckIndexSort(g.IndexSort); err != nil {
+		return nil, err
+	}
+	if err := CheckIndexGroup(g.IndexGroup); err != nil {
+		return nil, err
+	}
+
+	var albums []*indexAlbum
+
+	for _, album := range g.albums {
+		// An album without images has no pages to link to.
+		if len(album.chosenImages) == 0 {
 			continue
 		}
 
-		_ = fh.Close()
-		return fmt.Errorf("unexpected line in file: %s", text)
+		// We can't show a protected album's thumbnails.
+		thumb := lockedThumbFilename
+		if !album.protected() {
+			thumb = album.GetThumb().ThumbnailFilename
+		}
+
+		a := &indexAlbum{
+			html: HTMLAlbum{
+				URL:      fmt.Sprintf("%s/index.html", album.InstallSubDir),
+				ThumbURL: fmt.Sprintf("%s/%s", album.InstallSubDir, thumb),
+				Name:     album.Name,
+			},
+			group: album.Group,
+		}
+
+		if g.IndexSort == "newest" || g.IndexGroup == "year" {
+			a.newest = album.newestTime()
+		}
+
+		albums = append(albums, a)
+	}
+
+	switch g.IndexSort {
+	case "", "file":
+	case "name":
+		sort.SliceStable(albums, func(i, j int) bool {
+			return strings.ToLower(albums[i].html.Name) <
+				strings.ToLower(albums[j].html.Name)
+		})
+	case "newest":
+		sort.SliceStable(albums, func(i, j int) bool {
+			return albums[i].newest.After(albums[j].newest)
+		})
+	}
+
+	switch g.IndexGroup {
+	case "":
+	case "year":
+		// Newest years first. Undated albums are last.
+		year := func(a *indexAlbum) int {
+			if a.newest.IsZero() {
+				return 0
+			}
+			return a.newest.Year()
+		}
+
+		sort.SliceStable(albums, func(i, j int) bool {
+			return year(albums[i]) > year(albums[j])
+		})
+
+		for _, a := range albums {
+			a.group = "Undated"
+			if y := year(a); y != 0 {
+				a.group = strconv.Itoa(y)
+			}
+		}
+	case "group":
+		albums = groupIndexAlbums(albums)
+	}
+
+	pageSize := g.IndexPageSize
+	if pageSize <= 0 {
+		pageSize = len(albums)
+	}
+
+	var pages [][]HTMLAlbumGroup
+
+	for start := 0; start < len(albums); start += pageSize {
+		end := start + pageSize
+		if end > len(albums) {
+			end = len(albums)
+		}
+
+		var groups []HTMLAlbumGroup
+		for i, a := range albums[start:end] {
+			if i == 0 || a.group != groups[len(groups)-1].Name {
+				groups = append(groups, HTMLAlbumGroup{Name: a.group})
+			}
+			groups[len(groups)-1].Albums = append(groups[len(groups)-1].Albums,
+				a.html)
+		}
+
+		pages = append(pages, groups)
+	}
+
+	// Even with no albums there is an index page.
+	if len(pages) == 0 {
+		pages = append(pages, nil)
+	}
+
+	return pages, nil
+}
+
+// groupIndexAlbums puts albums with the same group together. Groups are in
+// the order their first album is.
+func groupIndexAlbums(albums []*indexAlbum) []*indexAlbum {
+	var names []string
+	byGroup := map[string][]*indexAlbum{}
+
+	for _, a := range albums {
+		if _, ok := byGroup[a.group]; !ok {
+			names = append(names, a.group)
+		}
+		byGroup[a.group] = append(byGroup[a.group], a)
+	}
+
+	var grouped []*indexAlbum
+	for _, name := range names {
+		grouped = append(grouped, byGroup[name]...)
 	}
 
-	err = g.loadAlbum(albumName, albumDir, albumSubDir, albumFile, albumTags)
+	return grouped
+}
+
+// load a gallery's information from a gallery file.
+//
+// Format of the gallery file: It is made of blocks that look like this:
+//
+// album-name   = Name/title of an album. Human readable.
+// album-dir    = Path to the directory containing the album's original images.
+// album-subdir = A name for the album suitable as a directory name. Not
+//                absolute. We install images here and store them here in a
+//                subdir to avoid collisions with other albums.
+// album-file   = Path to a file describing the album's images. Optional. If
+//                there is none, the album is every image in album-dir.
+// album-tags   = Comma separated list of tags to use to decide what images
+//                from the album to include. If this is empty then we include
+//                all images.
+//
+// Each block starts with album-name. A block may also have:
+//
+// album-dir-order    = How to order the images if there is no album file.
+//                      name (the default) or time (when each was taken).
+// album-metadata     = Whether to read metadata from the images and their XMP
+//                      sidecar files (EXIF, XMP, IPTC). We use captions as
+//                      descriptions where the album file has none, and add
+//                      keywords and star ratings (such as rating-5) to the
+//                      images' tags. true or false. Default false.
+// album-min-rating   = Include only images rated at least this many stars (1
+//                      to 5). Ratings come from Rating: lines in the album
+//                      file and, with album-metadata, from the images.
+// album-show-ratings = Whether to show ratings as stars. Default false.
+// album-sort         = How to order the images: file (the default),
+//                      filename, time, time-desc, rating, or random. See
+//                      Album.Sort.
+// album-sort-seed    = Seed for album-sort = random. Default 0. Change it for
+//                      a different order.
+// album-highlights   = Whether to show the highest rated images first. This
+//                      is the same as album-sort = rating.
+// album-group        = The section of the gallery index the album is in, if
+//                      index-group = group.
+// album-map          = Whether to make a page with a map showing where the
+//                      images were taken. The gallery has a map of the
+//                      images of all albums with one. Default false.
+// album-password     = Protect the album with this password. See
+//                      Album.Password.
+//
+// It may override the gallery's settings for the album too:
+//
+// album-thumbnail-size    = ThumbnailSize
+// album-large-image-size  = LargeImageSize
+// album-page-size         = PageSize
+// album-include-zips      = IncludeZip (true or false)
+// album-include-originals = IncludeOriginals (true or false)
+//
+// Rather than album-name, a block may start with album-glob. This is a pattern
+// matching directories (see filepath.Glob()). Each directory holding an album
+// file becomes an album, named after the directory. The block's other settings
+// apply to each of these albums:
+//
+// album-glob      = Pattern matching album directories.
+// album-glob-file = Name of the album file in each directory. Default is
+//                   images.txt. If blank, every matching directory is an
+//                   album of the images in it.
+//
+// Each album's subdir is its directory's name. If a directory has a block of
+// its own, we use it instead. This way you can set an album's name and other
+// settings.
+//
+// The file may include others, such as to split up a large gallery:
+//
+// include = Path to a gallery file. Relative to the including file.
+//
+// In an included file, relative album-dir, album-file, and album-glob paths
+// are relative to it too.
+//
+// The file may also have gallery-wide settings. These are typically at the
+// top. Refer to the Gallery fields of the same names for what they mean:
+//
+// title             = Name
+// install-dir       = InstallDir
+// thumbnail-size    = ThumbnailSize
+// large-image-size  = LargeImageSize
+// page-size         = PageSize
+// include-zips      = IncludeZips (true or false)
+// include-originals = IncludeOriginals (true or false)
+// convert-originals = ConvertOriginals (true or false)
+// base-url          = BaseURL
+// theme             = Theme
+// index-page-size   = IndexPageSize
+// index-sort        = IndexSort
+// index-group       = IndexGroup
+// timeline          = Timeline (true or false)
+// map-tile-url      = MapTileURL
+// map-attribution   = MapAttribution
+//
+// We don't apply the gallery-wide settings here. See ReadGalleryConfig().
+func (g *Gallery) load(file string) error {
+	f := g.parsed
+	g.parsed = nil
+
+	if f == nil {
+		var err error
+		f, err = readGalleryFile(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	blocks, err := f.albumBlocks()
 	if err != nil {
-		_ = fh.Close()
 		return err
 	}
 
-	if scanner.Err() != nil {
-		return fmt.Errorf("scanner: %s", err)
+	if len(blocks) == 0 {
+		return fmt.Errorf("no albums found")
 	}
 
-	err = fh.Close()
-	if err != nil {
-		return fmt.Errorf("close: %s", err)
+	g.albums = nil
+	g.files = f.files
+	g.globs = f.globBlocks()
+
+	subDirs := map[string]bool{}
+
+	for _, block := range blocks {
+		if subDirs[filepath.Clean(block.subDir)] {
+			return fmt.Errorf("more than one album has subdirectory: %s",
+				block.subDir)
+		}
+		subDirs[filepath.Clean(block.subDir)] = true
+
+		if err := g.loadAlbum(block); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (g *Gallery) loadAlbum(name, dir, subDir, file, tags string) error {
-	if len(name) == 0 {
+func (g *Gallery) loadAlbum(block *albumBlock) error {
+	if len(block.name) == 0 {
 		return fmt.Errorf("blank name")
 	}
 
-	if len(dir) == 0 {
-		return fmt.Errorf("no directory provided")
+	if len(block.dir) == 0 {
+		return fmt.Errorf("no directory provided: %s", block.name)
 	}
 
-	if len(subDir) == 0 {
-		return fmt.Errorf("no subdirectory provided")
+	if len(block.subDir) == 0 {
+		return fmt.Errorf("no subdirectory provided: %s", block.name)
 	}
 
-	if len(file) == 0 {
-		return fmt.Errorf("no file provided")
+	baseURL := ""
+	if g.BaseURL != "" {
+		baseURL = pageURL(g.BaseURL, block.subDir)
 	}
 
 	album := &Album{
-		Name:                name,
-		File:                file,
-		OrigImageDir:        dir,
-		InstallDir:          filepath.Join(g.InstallDir, subDir),
-		InstallSubDir:       subDir,
+		Name:                block.name,
+		File:                block.file,
+		DirOrder:            block.dirOrder,
+		MinRating:           block.minRating,
+		Sort:                block.sort,
+		SortSeed:            block.sortSeed,
+		Group:               block.group,
+		MapTileURL:          g.MapTileURL,
+		MapAttribution:      g.MapAttribution,
+		OrigImageDir:        block.dir,
+		InstallDir:          filepath.Join(g.InstallDir, block.subDir),
+		InstallSubDir:       block.subDir,
 		ThumbnailSize:       g.ThumbnailSize,
 		LargeImageSize:      g.LargeImageSize,
 		PageSize:            g.PageSize,
 		Workers:             g.Workers,
+		MemoryBudget:        g.MemoryBudget,
+		Processor:           g.Processor,
 		Verbose:             g.Verbose,
 		IncludeZip:          g.IncludeZips,
 		IncludeOriginals:    g.IncludeOriginals,
+		ConvertOriginals:    g.ConvertOriginals,
 		ForceGenerateImages: g.ForceGenerateImages,
 		ForceGenerateHTML:   g.ForceGenerateHTML,
 		ForceGenerateZip:    g.ForceGenerateZip,
 		GalleryName:         g.Name,
+		BaseURL:             baseURL,
+		Theme:               g.Theme,
+		Password:            block.password,
+	}
+
+	if block.thumbnailSize != nil {
+		album.ThumbnailSize = *block.thumbnailSize
+	}
+	if block.largeImageSize != nil {
+		album.LargeImageSize = *block.largeImageSize
+	}
+	if block.pageSize != nil {
+		album.PageSize = *block.pageSize
+	}
+	if block.includeZip != nil {
+		album.IncludeZip = *block.includeZip
+	}
+	if block.includeOriginals != nil {
+		album.IncludeOriginals = *block.includeOriginals
+	}
+	if block.readMetadata != nil {
+		album.ReadMetadata = *block.readMetadata
+	}
+	if block.showRatings != nil {
+		album.ShowRatings = *block.showRatings
+	}
+	if block.showMap != nil {
+		album.Map = *block.showMap
 	}
 
-	tagsRaw := strings.Split(tags, ",")
+	tagsRaw := strings.Split(block.tags, ",")
 	for _, tag := range tagsRaw {
 		tag = strings.TrimSpace(tag)
 		if len(tag) == 0 {
@@ -0,0 +1,577 @@
+package gallery
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// GalleryConfig holds gallery-wide settings from a gallery file. A field is
+// nil if the file does not set it.
+//
+// For the settings, refer to Gallery.load().
+type GalleryConfig struct {
+	Name             *string
+	InstallDir       *string
+	ThumbnailSize    *int
+	LargeImageSize   *int
+	PageSize         *int
+	IncludeZips      *bool
+	IncludeOriginals *bool
+	ConvertOriginals *bool
+	BaseURL          *string
+	Theme            *string
+	IndexPageSize    *int
+	IndexSort        *string
+	IndexGroup       *string
+	Timeline         *bool
+	MapTileURL       *string
+	MapAttribution   *string
+
+	// The file we read these from, and what we read.
+	path string
+	file *galleryFile
+}
+
+// defaultGlobFile is the album file we look for in directories matching an
+// album-glob.
+const defaultGlobFile = "images.txt"
+
+// albumSorts are the values album-sort may have. See Album.Sort.
+var albumSorts = map[string]bool{
+	"file":      true,
+	"filename":  true,
+	"time":      true,
+	"time-desc": true,
+	"rating":    true,
+	"random":    true,
+}
+
+// galleryFile is what we read from a gallery file.
+type galleryFile struct {
+	config GalleryConfig
+	albums []*albumBlock
+
+	// The gallery file and those it includes.
+	files []string
+}
+
+// albumBlock holds the settings for one album from a gallery file.
+//
+// Or, if glob is set, for each album in the directories matching it. Then the
+// other settings apply to every one of these albums.
+type albumBlock struct {
+	glob     string
+	globFile string
+
+	name   string
+	dir    string
+	subDir string
+	file   string
+	tags   string
+
+	dirOrder     string
+	readMetadata *bool
+
+	minRating   int
+	showRatings *bool
+
+	sort     string
+	sortSeed int64
+	group    string
+
+	showMap *bool
+
+	password string
+
+	// Settings overriding the gallery's. nil if not set.
+	thumbnailSize    *int
+	largeImageSize   *int
+	pageSize         *int
+	includeZip       *bool
+	includeOriginals *bool
+}
+
+// ReadGalleryConfig reads the gallery-wide settings from a gallery file.
+//
+// We don't apply these when installing a gallery. This is so that you can
+// decide which take precedence over your own. See Apply().
+func ReadGalleryConfig(file string) (*GalleryConfig, error) {
+	f, err := readGalleryFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	config := f.config
+	config.path = file
+	config.file = f
+
+	return &config, nil
+}
+
+// Apply sets the gallery's fields from the settings the file has.
+//
+// If the gallery's File is the file these came from, the gallery's next load
+// uses what we read rather than parsing the file again.
+func (c *GalleryConfig) Apply(g *Gallery) {
+	if c.file != nil && samePath(c.path, g.File) {
+		g.parsed = c.file
+	}
+
+	if c.Name != nil {
+		g.Name = *c.Name
+	}
+	if c.InstallDir != nil {
+		g.InstallDir = *c.InstallDir
+	}
+	if c.ThumbnailSize != nil {
+		g.ThumbnailSize = *c.ThumbnailSize
+	}
+	if c.LargeImageSize != nil {
+		g.LargeImageSize = *c.LargeImageSize
+	}
+	if c.PageSize != nil {
+		g.PageSize = *c.PageSize
+	}
+	if c.IncludeZips != nil {
+		g.IncludeZips = *c.IncludeZips
+	}
+	if c.IncludeOriginals != nil {
+		g.IncludeOriginals = *c.IncludeOriginals
+	}
+	if c.ConvertOriginals != nil {
+		g.ConvertOriginals = *c.ConvertOriginals
+	}
+	if c.BaseURL != nil {
+		g.BaseURL = *c.BaseURL
+	}
+	if c.Theme != nil {
+		g.Theme = *c.Theme
+	}
+	if c.IndexPageSize != nil {
+		g.IndexPageSize = *c.IndexPageSize
+	}
+	if c.IndexSort != nil {
+		g.IndexSort = *c.IndexSort
+	}
+	if c.IndexGroup != nil {
+		g.IndexGroup = *c.IndexGroup
+	}
+	if c.Timeline != nil {
+		g.Timeline = *c.Timeline
+	}
+	if c.MapTileURL != nil {
+		g.MapTileURL = *c.MapTileURL
+	}
+	if c.MapAttribution != nil {
+		g.MapAttribution = *c.MapAttribution
+	}
+}
+
+// readGalleryFile parses a gallery file, along with any it includes.
+func readGalleryFile(file string) (*galleryFile, error) {
+	f := &galleryFile{}
+
+	if err := f.read(file, nil); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// read parses a gallery file. including holds the files including this one,
+// so that we can tell if a file includes itself.
+func (f *galleryFile) read(file string, including []string) error {
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+
+	for _, parent := range including {
+		if parent == absFile {
+			return fmt.Errorf("file includes itself: %s", file)
+		}
+	}
+
+	fh, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+
+	f.files = append(f.files, file)
+
+	var album *albumBlock
+
+	scanner := bufio.NewScanner(fh)
+
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 {
+			continue
+		}
+
+		if text[0] == '#' {
+			continue
+		}
+
+		pieces := strings.SplitN(text, "=", 2)
+		if len(pieces) != 2 {
+			_ = fh.Close()
+			return fmt.Errorf("malformed line: %s", text)
+		}
+
+		key := strings.TrimSpace(pieces[0])
+		value := strings.TrimSpace(pieces[1])
+
+		if key == "include" {
+			// Relative to the including file.
+			path := value
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(filepath.Dir(file), path)
+			}
+
+			if err := f.read(path, append(including, absFile)); err != nil {
+				_ = fh.Close()
+				return fmt.Errorf("unable to include: %s: %s", path, err)
+			}
+
+			// Settings after an include don't go in the last album it had.
+			album = nil
+			continue
+		}
+
+		if key == "album-name" {
+			album = &albumBlock{name: value}
+			f.albums = append(f.albums, album)
+			continue
+		}
+
+		// Paths in included files are relative to them, like includes.
+		if key == "album-glob" || key == "album-dir" || key == "album-file" {
+			value = resolvePath(file, value, len(including) > 0)
+		}
+
+		if key == "album-glob" {
+			if _, err := filepath.Match(value, ""); err != nil {
+				_ = fh.Close()
+				return fmt.Errorf("invalid album-glob: %s: %s", value, err)
+			}
+
+			album = &albumBlock{glob: value, globFile: defaultGlobFile}
+			f.albums = append(f.albums, album)
+			continue
+		}
+
+		if strings.HasPrefix(key, "album-") {
+			if album == nil {
+				_ = fh.Close()
+				return fmt.Errorf("%s must come after album-name or album-glob",
+					key)
+			}
+
+			ok, err := album.set(key, value)
+			if err != nil {
+				_ = fh.Close()
+				return fmt.Errorf("%s: %s", key, err)
+			}
+			if ok {
+				continue
+			}
+		}
+
+		ok, err := f.config.set(key, value)
+		if err != nil {
+			_ = fh.Close()
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		if ok {
+			continue
+		}
+
+		_ = fh.Close()
+		return fmt.Errorf("unexpected line in file: %s", text)
+	}
+
+	if err := scanner.Err(); err != nil {
+		_ = fh.Close()
+		return fmt.Errorf("scanner: %s", err)
+	}
+
+	if err := fh.Close(); err != nil {
+		return fmt.Errorf("close: %s", err)
+	}
+
+	return nil
+}
+
+// resolvePath returns the path a path in a gallery file refers to. In an
+// included file, a relative path is relative to that file. In the gallery file
+// itself it is relative to the working directory, as it always has been.
+func resolvePath(file, path string, included bool) string {
+	if !included || path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(file), path)
+}
+
+// globBlocks returns the album-glob blocks.
+func (f *galleryFile) globBlocks() []*albumBlock {
+	var blocks []*albumBlock
+	for _, block := range f.albums {
+		if block.glob != "" {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// globBase returns the directory at the start of a glob pattern that has no
+// pattern characters in it. Directories matching the pattern appear in it.
+func globBase(pattern string) string {
+	dir := filepath.Dir(pattern)
+	for strings.ContainsAny(dir, "*?[") {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+// albumBlocks returns a block for each album. We expand album-glob blocks into
+// one for each directory matching the pattern that has an album file. If the
+// block has no album file name, each matching directory is an album.
+//
+// If a directory has its own block elsewhere, we use that rather than making
+// one for it from a glob.
+func (f *galleryFile) albumBlocks() ([]*albumBlock, error) {
+	explicitDirs := map[string]bool{}
+	for _, block := range f.albums {
+		if block.glob == "" {
+			explicitDirs[filepath.Clean(block.dir)] = true
+		}
+	}
+
+	var blocks []*albumBlock
+
+	for _, block := range f.albums {
+		if block.glob == "" {
+			blocks = append(blocks, block)
+			continue
+		}
+
+		dirs, err := filepath.Glob(block.glob)
+		if err != nil {
+			return nil, fmt.Errorf("invalid album-glob: %s: %s", block.glob, err)
+		}
+
+		for _, dir := range dirs {
+			if explicitDirs[filepath.Clean(dir)] {
+				continue
+			}
+
+			// Without an album file name, every directory is an album of the
+			// images in it.
+			albumFile := ""
+			if block.globFile != "" {
+				albumFile = filepath.Join(dir, block.globFile)
+				exists, err := fileExists(albumFile)
+				if err != nil {
+					return nil, err
+				}
+				if !exists {
+					continue
+				}
+			} else {
+				fi, err := os.Stat(dir)
+				if err != nil {
+					return nil, err
+				}
+				if !fi.IsDir() {
+					continue
+				}
+			}
+
+			// The block's settings apply to each album. The name and subdir come
+			// from the directory.
+			globbed := *block
+			globbed.glob = ""
+			globbed.dir = dir
+			globbed.file = albumFile
+			globbed.name = filepath.Base(dir)
+			globbed.subDir = filepath.Base(dir)
+
+			blocks = append(blocks, &globbed)
+		}
+	}
+
+	return blocks, nil
+}
+
+// set sets an album setting. It returns false if the key is not one.
+func (b *albumBlock) set(key, value string) (bool, error) {
+	switch key {
+	case "album-dir":
+		if b.glob != "" {
+			return true, fmt.Errorf("not for album-glob blocks")
+		}
+		b.dir = value
+	case "album-subdir":
+		if b.glob != "" {
+			return true, fmt.Errorf("not for album-glob blocks")
+		}
+		b.subDir = value
+	case "album-file":
+		if b.glob != "" {
+			return true, fmt.Errorf("not for album-glob blocks. Use album-glob-file")
+		}
+		b.file = value
+	case "album-tags":
+		b.tags = value
+	case "album-glob-file":
+		if b.glob == "" {
+			return true, fmt.Errorf("only for album-glob blocks")
+		}
+		b.globFile = value
+	case "album-dir-order":
+		if value != "name" && value != "time" {
+			return true, fmt.Errorf("must be name or time: %s", value)
+		}
+		b.dirOrder = value
+	case "album-metadata":
+		return true, setBool(&b.readMetadata, value)
+	case "album-min-rating":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 5 {
+			return true, fmt.Errorf("must be 1 to 5: %s", value)
+		}
+		b.minRating = n
+	case "album-show-ratings":
+		return true, setBool(&b.showRatings, value)
+	case "album-highlights":
+		// The same as sorting by rating.
+		var highlights *bool
+		if err := setBool(&highlights, value); err != nil {
+			return true, err
+		}
+		if *highlights {
+			b.sort = "rating"
+		} else if b.sort == "rating" {
+			b.sort = ""
+		}
+	case "album-sort":
+		if !albumSorts[value] {
+			return true, fmt.Errorf("unknown sort: %s", value)
+		}
+		b.sort = value
+	case "album-group":
+		b.group = value
+	case "album-map":
+		return true, setBool(&b.showMap, value)
+	case "album-password":
+		b.password = value
+	case "album-sort-seed":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return true, fmt.Errorf("invalid number: %s", value)
+		}
+		b.sortSeed = n
+	case "album-thumbnail-size":
+		return true, setSize(&b.thumbnailSize, value)
+	case "album-large-image-size":
+		return true, setSize(&b.largeImageSize, value)
+	case "album-page-size":
+		return true, setSize(&b.pageSize, value)
+	case "album-include-zips":
+		return true, setBool(&b.includeZip, value)
+	case "album-include-originals":
+		return true, setBool(&b.includeOriginals, value)
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// set sets a gallery-wide setting. It returns false if the key is not one.
+func (c *GalleryConfig) set(key, value string) (bool, error) {
+	switch key {
+	case "title":
+		if value == "" {
+			return true, fmt.Errorf("title must not be blank")
+		}
+		c.Name = &value
+	case "install-dir":
+		c.InstallDir = &value
+	case "thumbnail-size":
+		return true, setSize(&c.ThumbnailSize, value)
+	case "large-image-size":
+		return true, setSize(&c.LargeImageSize, value)
+	case "page-size":
+		return true, setSize(&c.PageSize, value)
+	case "include-zips":
+		return true, setBool(&c.IncludeZips, value)
+	case "include-originals":
+		return true, setBool(&c.IncludeOriginals, value)
+	case "convert-originals":
+		return true, setBool(&c.ConvertOriginals, value)
+	case "base-url":
+		c.BaseURL = &value
+	case "theme":
+		c.Theme = &value
+	case "index-page-size":
+		return true, setSize(&c.IndexPageSize, value)
+	case "index-sort":
+		if err := CheckIndexSort(value); err != nil {
+			return true, err
+		}
+		c.IndexSort = &value
+	case "index-group":
+		if err := CheckIndexGroup(value); err != nil {
+			return true, err
+		}
+		c.IndexGroup = &value
+	case "timeline":
+		return true, setBool(&c.Timeline, value)
+	case "map-tile-url":
+		if value != "" && (!strings.Contains(value, "{z}") ||
+			!strings.Contains(value, "{x}") || !strings.Contains(value, "{y}")) {
+			return true, fmt.Errorf("must have {z}, {x}, and {y}: %s", value)
+		}
+		c.MapTileURL = &value
+	case "map-attribution":
+		c.MapAttribution = &value
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// setSize parses a size, which must be positive.
+func setSize(field **int, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid number: %s", value)
+	}
+
+	if n <= 0 {
+		return fmt.Errorf("must be positive: %d", n)
+	}
+
+	*field = &n
+
+	return nil
+}
+
+// setBool parses a boolean such as true or false.
+func setBool(field **bool, value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid boolean: %s", value)
+	}
+
+	*field = &b
+
+	return nil
+}
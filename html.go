@@ -3,19 +3,27 @@ package gallery
 import (
 	"fmt"
 	"html/template"
+	"io"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // HTMLImage holds image info needed in HTML.
 type HTMLImage struct {
 	IncludeOriginals bool
 	OriginalImageURL string
+	OriginalFormat   string
+	ImageName        string
 	FullImageURL     string
 	ThumbImageURL    string
 	Description      string
 	Index            int
+
+	// The image's rating as stars, such as ★★★☆☆. Blank if we don't show it.
+	Stars string
 }
 
 // HTMLAlbum holds info needed in HTML about an album.
@@ -25,6 +33,13 @@ type HTMLAlbum struct {
 	Name     string
 }
 
+// HTMLAlbumGroup is a section of the gallery index. Name is blank if the
+// index has no sections.
+type HTMLAlbumGroup struct {
+	Name   string
+	Albums []HTMLAlbum
+}
+
 const css = `
 body {
 	margin: 0;
@@ -35,6 +50,10 @@ body {
 	text-align: center;
 }
 
+#albums h2 {
+	margin: 20px 0 10px 0;
+}
+
 .album {
 	display: inline-block;
 	width: 250px;
@@ -67,6 +86,25 @@ body {
 	display: inline-block;
 }
 
+.rating {
+	color: #c90;
+	margin: 0;
+}
+
+.calendar {
+	margin: 0 50px 15px 50px;
+	border-collapse: collapse;
+}
+
+.calendar th, .calendar td {
+	padding: 4px 8px;
+	text-align: center;
+}
+
+.month {
+	margin: 0 50px 15px 50px;
+}
+
 img {
 	max-width: 100%;
 }
@@ -78,97 +116,205 @@ img {
 }
 `
 
+// darkCSS is added to css for the dark theme.
+const darkCSS = `
+body {
+	background-color: #111;
+	color: #ddd;
+}
+
+a {
+	color: #8ab4f8;
+}
+
+a:visited {
+	color: #c58af9;
+}
+`
+
+// themeCSS returns the stylesheet for the given theme. The theme is the name
+// of one of ours (light or dark), or the path to a CSS file. A CSS file adds to
+// the light theme. Blank means light.
+func themeCSS(theme string) (template.CSS, error) {
+	switch theme {
+	case "", "light":
+		return template.CSS(css), nil
+	case "dark":
+		return template.CSS(css + darkCSS), nil
+	}
+
+	buf, err := os.ReadFile(theme)
+	if err != nil {
+		return "", fmt.Errorf("unable to read theme: %s", err)
+	}
+
+	return template.CSS(css + string(buf)), nil
+}
+
+// pageURL returns the absolute URL of a page given the URL of its directory.
+// If we don't know the URL of the directory, it is blank. The filename may be
+// a path such as an album's nested subdirectory.
+func pageURL(baseURL, filename string) string {
+	if baseURL == "" {
+		return ""
+	}
+
+	segments := strings.Split(filepath.ToSlash(filename), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return strings.TrimSuffix(baseURL, "/") + "/" + strings.Join(segments, "/")
+}
+
 // makeGalleryHTML creates an HTML file that acts as the top level of the
-// gallery. This is a single page that links to all albums.
-func makeGalleryHTML(installDir, name string, albums []HTMLAlbum,
-	verbose, forceGenerate bool) error {
-	htmlPath := filepath.Join(installDir, "index.html")
+// gallery. This is the given page of those linking to the albums. Page 1 is
+// index.html. The albums may be in sections. If timelineURL or mapURL are set,
+// we link to the timeline or map.
+//
+// It returns whether we wrote the file. We don't if it exists, unless forced.
+// The same goes for the other make*HTML functions.
+func makeGalleryHTML(installDir, name string, groups []HTMLAlbumGroup,
+	totalPages, page int, timelineURL, mapURL string, style template.CSS,
+	baseURL string, logger *log.Logger, verbose, forceGenerate bool) (bool,
+	error) {
+	htmlPath := filepath.Join(installDir, albumPageFilename(page))
 	exists, err := fileExists(htmlPath)
 	if err != nil {
-		return fmt.Errorf("failed to check if HTML exists: %s: %s", htmlPath, err)
+		return false, fmt.Errorf("failed to check if HTML exists: %s: %s", htmlPath, err)
 	}
 
 	if !forceGenerate && exists {
-		return nil
+		return false, nil
 	}
 
 	if err := makeDirIfNotExist(installDir); err != nil {
-		return err
+		return false, err
 	}
 
 	const tpl = `<!DOCTYPE html>
 <meta charset="utf-8">
 <title>{{.Name}}</title>
 <meta name="viewport" content="width=device-width, user-scalable=no">
-<style>` + css + `</style>
+<style>{{.CSS}}</style>
+{{if .URL}}<link rel="canonical" href="{{.URL}}">{{end}}
 <h1>{{.Name}}</h1>
 
+{{if or (gt .TotalPages 1) .TimelineURL .MapURL}}
+<div id="nav">
+	Navigation:
+	{{if .TimelineURL}}
+		<a href="{{.TimelineURL}}">Timeline</a>
+		{{if or (gt .TotalPages 1) .MapURL}}|{{end}}
+	{{end}}
+
+	{{if .MapURL}}
+		<a href="{{.MapURL}}">Map</a>
+		{{if gt .TotalPages 1}}|{{end}}
+	{{end}}
+
+	{{if gt .TotalPages 1}}
+		{{if .PreviousURL}}
+			<a href="{{.PreviousURL}}">Previous page</a> |
+		{{else}}
+			Previous page |
+		{{end}}
+
+		{{if .NextURL}}
+			<a href="{{.NextURL}}">Next page</a>
+		{{else}}
+			Next page
+		{{end}}
+
+		(This is page {{.Page}}/{{.TotalPages}})
+	{{end}}
+</div>
+{{end}}
+
 <div id="albums">
-	{{range .Albums}}
-		<div class="album">
-			<a href="{{.URL}}"><img src="{{.ThumbURL}}"></a>
-			<p><a href="{{.URL}}">{{.Name}}</a></p>
-		</div>
+	{{range .Groups}}
+		{{if .Name}}
+			<h2>{{.Name}}</h2>
+		{{end}}
+		{{range .Albums}}
+			<div class="album">
+				<a href="{{.URL}}"><img src="{{.ThumbURL}}"></a>
+				<p><a href="{{.URL}}">{{.Name}}</a></p>
+			</div>
+		{{end}}
 	{{end}}
 </div>
 `
 
 	t, err := template.New("page").Parse(tpl)
 	if err != nil {
-		return fmt.Errorf("unable to parse HTML template: %s", err)
+		return false, fmt.Errorf("unable to parse HTML template: %s", err)
 	}
 
-	fh, err := os.Create(htmlPath)
-	if err != nil {
-		return fmt.Errorf("unable to open HTML file: %s", err)
+	previousURL := ""
+	if page > 1 {
+		previousURL = albumPageFilename(page - 1)
 	}
 
-	data := struct {
-		Name   string
-		Albums []HTMLAlbum
-	}{
-		Name:   name,
-		Albums: albums,
+	nextURL := ""
+	if page < totalPages {
+		nextURL = albumPageFilename(page + 1)
 	}
 
-	if err := t.Execute(fh, data); err != nil {
-		_ = fh.Close()
-		return fmt.Errorf("unable to execute template: %s", err)
+	data := struct {
+		Name        string
+		Groups      []HTMLAlbumGroup
+		TotalPages  int
+		Page        int
+		PreviousURL string
+		NextURL     string
+		TimelineURL string
+		MapURL      string
+		CSS         template.CSS
+		URL         string
+	}{
+		Name:        name,
+		Groups:      groups,
+		TimelineURL: timelineURL,
+		MapURL:      mapURL,
+		TotalPages:  totalPages,
+		Page:        page,
+		PreviousURL: previousURL,
+		NextURL:     nextURL,
+		CSS:         style,
+		URL:         pageURL(baseURL, albumPageFilename(page)),
 	}
 
-	if err := fh.Close(); err != nil {
-		return fmt.Errorf("close: %s", err)
+	if err := writeTemplate(htmlPath, t, data); err != nil {
+		return false, err
 	}
 
 	if verbose {
-		log.Printf("Wrote HTML file: %s", htmlPath)
+		logger.Printf("Wrote HTML file: %s", htmlPath)
 	}
-	return nil
+	return true, nil
 }
 
 // generate and write an HTML page for an album.
 //
 // This is the top level page of an album and shows potentially multiple images.
 //
-// galleryName is optional. It may be we are creating a standalone album.
+// galleryName is optional. It may be we are creating a standalone album. So is
+// mapURL. If set, we link to the album's map.
+//
+// If lock is set, the album is protected. We write the page encrypted with it.
 func makeAlbumPageHTML(totalPages, totalImages, page int,
-	images []HTMLImage, installDir, name, galleryName string,
-	verbose, forceGenerate, includeZip bool) error {
-	// Figure out filename to write.
-	// Page 1 is index.html. The rest are page-n.html
-	filename := "index.html"
-	if page > 1 {
-		filename = fmt.Sprintf("page-%d.html", page)
-	}
-
-	htmlPath := filepath.Join(installDir, filename)
+	images []HTMLImage, installDir, name, galleryName, mapURL string,
+	style template.CSS, baseURL string, lock *albumLock, logger *log.Logger,
+	verbose, forceGenerate, includeZip bool) (bool, error) {
+	htmlPath := filepath.Join(installDir, albumPageFilename(page))
 	exists, err := fileExists(htmlPath)
 	if err != nil {
-		return fmt.Errorf("failed to check if HTML exists: %s: %s", htmlPath, err)
+		return false, fmt.Errorf("failed to check if HTML exists: %s: %s", htmlPath, err)
 	}
 
 	if !forceGenerate && exists {
-		return nil
+		return false, nil
 	}
 
 	const tpl = `<!DOCTYPE html>
@@ -179,7 +325,8 @@ func makeAlbumPageHTML(totalPages, totalImages, page int,
 <title>{{.Name}}</title>
 {{end}}
 <meta name="viewport" content="width=device-width, user-scalable=no">
-<style>` + css + `</style>
+<style>{{.CSS}}</style>
+{{if .URL}}<link rel="canonical" href="{{.URL}}">{{end}}
 <h1>{{.Name}} ({{.TotalImages}} images)</h1>
 
 <div id="nav">
@@ -203,6 +350,10 @@ func makeAlbumPageHTML(totalPages, totalImages, page int,
 	{{if gt .TotalPages 1}}
 		(This is page {{.Page}}/{{.TotalPages}})
 	{{end}}
+
+	{{if .MapURL}}
+		| <a href="{{.MapURL}}">Map</a>
+	{{end}}
 </div>
 
 <div id="images">
@@ -211,6 +362,9 @@ func makeAlbumPageHTML(totalPages, totalImages, page int,
 			<a href="image-{{.Index}}.html">
 				<img src="{{.ThumbImageURL}}">
 			</a>
+			{{if .Stars}}
+				<p class="rating">{{.Stars}}</p>
+			{{end}}
 		</div>
 	{{end}}
 </div>
@@ -222,12 +376,7 @@ func makeAlbumPageHTML(totalPages, totalImages, page int,
 
 	t, err := template.New("page").Parse(tpl)
 	if err != nil {
-		return fmt.Errorf("unable to parse HTML template: %s", err)
-	}
-
-	fh, err := os.Create(htmlPath)
-	if err != nil {
-		return fmt.Errorf("unable to open HTML file: %s", err)
+		return false, fmt.Errorf("unable to parse HTML template: %s", err)
 	}
 
 	previousURL := ""
@@ -254,6 +403,9 @@ func makeAlbumPageHTML(totalPages, totalImages, page int,
 		PreviousURL string
 		NextURL     string
 		IncludeZip  bool
+		MapURL      string
+		CSS         template.CSS
+		URL         string
 	}{
 		Name:        name,
 		GalleryName: galleryName,
@@ -264,21 +416,20 @@ func makeAlbumPageHTML(totalPages, totalImages, page int,
 		PreviousURL: previousURL,
 		NextURL:     nextURL,
 		IncludeZip:  includeZip,
+		MapURL:      mapURL,
+		CSS:         style,
+		URL:         pageURL(baseURL, albumPageFilename(page)),
 	}
 
-	if err := t.Execute(fh, data); err != nil {
-		_ = fh.Close()
-		return fmt.Errorf("unable to execute template: %s", err)
-	}
-
-	if err := fh.Close(); err != nil {
-		return fmt.Errorf("close: %s", err)
+	if err := writeAlbumTemplate(htmlPath, t, data, lock, name,
+		style); err != nil {
+		return false, err
 	}
 
 	if verbose {
-		log.Printf("Wrote HTML file: %s", htmlPath)
+		logger.Printf("Wrote HTML file: %s", htmlPath)
 	}
-	return nil
+	return true, nil
 }
 
 // Make an HTML page showing a single image.
@@ -286,24 +437,30 @@ func makeAlbumPageHTML(totalPages, totalImages, page int,
 // This page shows the larger size of the image. We link to the original image.
 //
 // galleryName is optional. It may be we are creating a standalone album.
+//
+// If lock is set, the album is protected. We write the page encrypted with it.
 func makeImagePageHTML(
 	image HTMLImage,
 	dir string,
 	totalImages int,
 	albumName,
 	galleryName string,
+	style template.CSS,
+	baseURL string,
+	lock *albumLock,
+	logger *log.Logger,
 	verbose,
 	forceGenerate bool,
 	page int,
-) error {
-	htmlPath := filepath.Join(dir, fmt.Sprintf("image-%d.html", image.Index))
+) (bool, error) {
+	htmlPath := filepath.Join(dir, imagePageFilename(image.Index))
 	exists, err := fileExists(htmlPath)
 	if err != nil {
-		return fmt.Errorf("failed to check if HTML exists: %s: %s", htmlPath, err)
+		return false, fmt.Errorf("failed to check if HTML exists: %s: %s", htmlPath, err)
 	}
 
 	if !forceGenerate && exists {
-		return nil
+		return false, nil
 	}
 
 	const tpl = `<!DOCTYPE html>
@@ -314,7 +471,12 @@ func makeImagePageHTML(
 <title>{{.ImageName}} - {{.AlbumName}}</title>
 {{end}}
 <meta name="viewport" content="width=device-width, user-scalable=no">
-<style>` + css + `</style>
+<style>{{.CSS}}</style>
+{{if .URL}}<link rel="canonical" href="{{.URL}}">{{end}}
+{{if .FullImageAbsoluteURL}}
+<meta property="og:title" content="{{.ImageName}}">
+<meta property="og:image" content="{{.FullImageAbsoluteURL}}">
+{{end}}
 <script>
 "use strict";
 
@@ -373,17 +535,20 @@ document.addEventListener('DOMContentLoaded', function() {
 	{{if .Description}}
 		<p>{{.Description}}</p>
 	{{end}}
+
+	{{if .Stars}}
+		<p class="rating">{{.Stars}}</p>
+	{{end}}
+
+	{{if .IncludeOriginals}}
+		<p><a href="{{.OriginalImageURL}}">Download original ({{.OriginalFormat}})</a></p>
+	{{end}}
 </div>
 `
 
 	t, err := template.New("page").Parse(tpl)
 	if err != nil {
-		return fmt.Errorf("unable to parse HTML template: %s", err)
-	}
-
-	fh, err := os.Create(htmlPath)
-	if err != nil {
-		return fmt.Errorf("unable to open HTML file: %s", err)
+		return false, fmt.Errorf("unable to parse HTML template: %s", err)
 	}
 
 	backURL := "index.html"
@@ -407,35 +572,101 @@ document.addEventListener('DOMContentLoaded', function() {
 		GalleryName      string
 		IncludeOriginals bool
 		OriginalImageURL string
+		OriginalFormat   string
 		FullImageURL     string
 		Description      string
+		Stars            string
 		BackURL          string
 		NextURL          string
 		PreviousURL      string
+		CSS              template.CSS
+		URL              string
+
+		// So that links shared elsewhere can show the image.
+		FullImageAbsoluteURL string
 	}{
-		ImageName:        image.OriginalImageURL,
+		ImageName:        image.ImageName,
 		AlbumName:        albumName,
 		GalleryName:      galleryName,
 		IncludeOriginals: image.IncludeOriginals,
 		OriginalImageURL: image.OriginalImageURL,
+		OriginalFormat:   image.OriginalFormat,
 		FullImageURL:     image.FullImageURL,
 		Description:      image.Description,
+		Stars:            image.Stars,
 		BackURL:          backURL,
 		NextURL:          nextURL,
 		PreviousURL:      previousURL,
+		CSS:              style,
+		URL:              pageURL(baseURL, imagePageFilename(image.Index)),
+
+		FullImageAbsoluteURL: pageURL(baseURL, image.FullImageURL),
 	}
 
-	if err := t.Execute(fh, data); err != nil {
-		_ = fh.Close()
-		return fmt.Errorf("unable to execute template: %s", err)
+	// Others can't show the image if it's encrypted.
+	if lock != nil {
+		data.FullImageAbsoluteURL = ""
 	}
 
-	if err := fh.Close(); err != nil {
-		return fmt.Errorf("close: %s", err)
+	if err := writeAlbumTemplate(htmlPath, t, data, lock, albumName,
+		style); err != nil {
+		return false, err
 	}
 
 	if verbose {
-		log.Printf("Wrote HTML file: %s", htmlPath)
+		logger.Printf("Wrote HTML file: %s", htmlPath)
+	}
+	return true, nil
+}
+
+// stars shows a rating as stars out of 5, such as ★★★☆☆. We show nothing for
+// images that aren't rated or are rejected.
+func stars(rating int) string {
+	if rating < 1 || rating > 5 {
+		return ""
 	}
-	return nil
+
+	return strings.Repeat("★", rating) + strings.Repeat("☆", 5-rating)
+}
+
+// albumPageFilename returns the filename of the given page of an album.
+//
+// Page 1 is index.html. The rest are page-n.html
+func albumPageFilename(page int) string {
+	if page > 1 {
+		return fmt.Sprintf("page-%d.html", page)
+	}
+	return "index.html"
+}
+
+// removePagesAfter removes the pages in the directory past the given number of
+// pages, such as from when there were more albums. We stop at the first page
+// that isn't there.
+func removePagesAfter(dir string, pages int) error {
+	for page := max(pages+1, 2); ; page++ {
+		err := os.Remove(filepath.Join(dir, albumPageFilename(page)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return fmt.Errorf("unable to remove page: %s", err)
+		}
+	}
+}
+
+// imagePageFilename returns the filename of the page showing the image with
+// the given index.
+func imagePageFilename(index int) string {
+	return fmt.Sprintf("image-%d.html", index)
+}
+
+// writeTemplate executes the template and writes the result to path
+// atomically.
+func writeTemplate(path string, t *template.Template, data interface{}) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		if err := t.Execute(w, data); err != nil {
+			return fmt.Errorf("unable to execute template: %s", err)
+		}
+		return nil
+	})
 }
@@ -2,12 +2,13 @@ package gallery
 
 import (
 	"fmt"
+	"image"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
-
-	"github.com/horgh/magick"
+	"time"
 )
 
 // Image holds image information from the metadata file.
@@ -24,6 +25,17 @@ type Image struct {
 	// Tags assigned to the image.
 	Tags []string
 
+	// Star rating from 1 to 5. 0 if not rated. -1 if rejected.
+	Rating int
+
+	// Where the image was taken. nil if we don't know.
+	Location *Location
+
+	// When the image was taken, or its modification time if it doesn't say.
+	// We only fill this in when we need it, such as to sort by it. Zero if we
+	// haven't.
+	Time time.Time
+
 	// Size for the thumbnail. Height/width in pixels.
 	ThumbnailSize int
 
@@ -44,9 +56,31 @@ type Image struct {
 	LargeImageFilename string
 }
 
+// convertFormats are the file extensions (lowercase, without the dot) of image
+// formats we accept as originals but which browsers can't display. We convert
+// these to JPEG.
+//
+// This is HEIC/HEIF from phones and the common camera RAW formats. Decoding
+// them requires ImageMagick to have the relevant delegates (libheif, libraw).
+var convertFormats = map[string]bool{
+	"heic": true,
+	"heif": true,
+	"dng":  true,
+	"cr2":  true,
+	"cr3":  true,
+	"nef":  true,
+	"nrw":  true,
+	"arw":  true,
+	"orf":  true,
+	"rw2":  true,
+	"raf":  true,
+	"pef":  true,
+	"srw":  true,
+}
+
 func (i Image) String() string {
-	return fmt.Sprintf("Filename: %s Description: %s Tags: %v", i.Filename,
-		i.Description, i.Tags)
+	return fmt.Sprintf("Filename: %s Description: %s Tags: %v Rating: %d",
+		i.Filename, i.Description, i.Tags, i.Rating)
 }
 
 // hasTag checks if the image has the given tag.
@@ -60,167 +94,350 @@ func (i Image) hasTag(tag string) bool {
 	return false
 }
 
-// Generate all images from the original, if necessary.
-func (i *Image) makeImages(dir string, verbose, forceGenerate bool) error {
-	if err := i.makeThumbnail(dir, verbose, forceGenerate); err != nil {
-		return err
+// extension returns the image's file extension, lowercase and without the dot.
+func (i Image) extension() string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(i.Filename), "."))
+}
+
+// needsConversion tells us whether the original is in a format browsers can't
+// display, meaning we must convert it to JPEG. See convertFormats.
+func (i Image) needsConversion() bool {
+	return convertFormats[i.extension()]
+}
+
+// OriginalFormat returns a human readable name of the original image's format,
+// such as JPEG or HEIC.
+func (i Image) OriginalFormat() string {
+	ext := i.extension()
+	if ext == "jpg" {
+		return "JPEG"
 	}
+	return strings.ToUpper(ext)
+}
 
-	return i.makeLargeImage(dir, verbose, forceGenerate)
+// convertedFilename returns the basename we use for the original image if we
+// convert it to JPEG. We keep its extension, such as IMG_1.HEIC.jpg. This way
+// it doesn't collide with IMG_1.JPG in the same album.
+func (i Image) convertedFilename() string {
+	return i.Filename + ".jpg"
 }
 
-// Create a thumbnail image.
+// derivative describes a resized version of an image that we generate.
+type derivative struct {
+	// Size in pixels. If the derivative is square, this is its width and
+	// height. Otherwise it is the maximum of its width and height.
+	size int
+
+	// Whether we crop the derivative to a square.
+	square bool
+
+	// Path to the derivative.
+	path string
+
+	// Set the image's fields referring to the derivative.
+	set func(path string)
+}
+
+// derivatives returns the resized versions of the image that we generate.
 //
-// It is thumbnailsize by thumbnailsize. We shrink it down then crop.
-func (i *Image) makeThumbnail(dir string, verbose, forceGenerate bool) error {
-	resizeFile, err := i.getResizedFilename(dir, i.ThumbnailSize, i.ThumbnailSize)
+// To add further sizes (such as for srcset), add them here.
+func (i *Image) derivatives(dir string) ([]*derivative, error) {
+	thumbPath, err := i.getResizedFilename(dir, i.ThumbnailSize, i.ThumbnailSize)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if !forceGenerate {
-		// If the resized version exists, nothing to do.
-		if _, err = os.Stat(resizeFile); err == nil {
-			i.ThumbnailPath = resizeFile
-			i.ThumbnailFilename = filepath.Base(resizeFile)
-			return nil
-		}
+	largePath, err := i.getResizedFilename(dir, i.LargeImageSize, -1)
+	if err != nil {
+		return nil, err
+	}
 
-		if !os.IsNotExist(err) {
-			return fmt.Errorf("stat: %s %s", resizeFile, err)
-		}
+	return []*derivative{
+		{
+			size:   i.ThumbnailSize,
+			square: true,
+			path:   thumbPath,
+			set: func(path string) {
+				i.ThumbnailPath = path
+				i.ThumbnailFilename = filepath.Base(path)
+			},
+		},
+		{
+			size: i.LargeImageSize,
+			path: largePath,
+			set: func(path string) {
+				i.LargeImagePath = path
+				i.LargeImageFilename = filepath.Base(path)
+			},
+		},
+	}, nil
+}
+
+// dimensions returns the width and height to scale an image of the given
+// dimensions to before we crop it (if the derivative is square).
+func (d *derivative) dimensions(width, height int) (int, int) {
+	if d.square {
+		return scaleToCover(width, height, d.size)
 	}
 
-	if verbose {
-		log.Printf("Creating image %s...", resizeFile)
+	// We don't make images larger.
+	if width <= d.size && height <= d.size {
+		return width, height
 	}
 
-	image, err := magick.NewFromFile(i.Path)
+	return scaleToFit(width, height, d.size)
+}
+
+// Generate all images from the original, if necessary.
+//
+// We decode the original only once. We create the derivatives from largest to
+// smallest, each one resized from the previous one.
+//
+// If lock is set, we encrypt the images with it.
+//
+// We return the paths to the images we created.
+func (i *Image) makeImages(proc ImageProcessor, dir string, lock *albumLock,
+	logger *log.Logger, verbose, forceGenerate bool) ([]string, error) {
+	derivatives, err := i.derivatives(dir)
 	if err != nil {
-		return fmt.Errorf("unable to open image: %s: %s", i.Filename, err)
+		return nil, err
 	}
 
-	if err := image.AutoOrient(); err != nil {
-		_ = image.Destroy()
-		return fmt.Errorf("unable to auto orient: %s: %s", i.Filename, err)
-	}
+	var todo []*derivative
+	for _, d := range derivatives {
+		if !forceGenerate {
+			exists, err := fileExists(d.path)
+			if err != nil {
+				return nil, fmt.Errorf("stat: %s %s", d.path, err)
+			}
 
-	// Resize.
-	if image.Width() > image.Height() {
-		if err := image.Resize(fmt.Sprintf("x%d", i.ThumbnailSize)); err != nil {
-			_ = image.Destroy()
-			return fmt.Errorf("unable to resize image: %s: %s", i.Filename, err)
-		}
-	} else {
-		if err := image.Resize(fmt.Sprintf("%dx", i.ThumbnailSize)); err != nil {
-			_ = image.Destroy()
-			return fmt.Errorf("unable to resize image: %s: %s", i.Filename, err)
+			// If the resized version exists, nothing to do.
+			if exists {
+				d.set(d.path)
+				continue
+			}
 		}
-	}
 
-	// Crop the image. Try to centre depending on which dimension is larger.
-	xOffset := 0
-	yOffset := 0
+		todo = append(todo, d)
+	}
 
-	if image.Width() > image.Height() {
-		diff := image.Width() - image.Height()
-		xOffset = diff / 2
-	} else if image.Height() > image.Width() {
-		diff := image.Height() - image.Width()
-		yOffset = diff / 2
+	if len(todo) == 0 {
+		return nil, nil
 	}
 
-	// ! says to ignore aspect ratio.
-	geometry := fmt.Sprintf("%dx%d!+%d+%d", i.ThumbnailSize, i.ThumbnailSize,
-		xOffset, yOffset)
+	// Cropping to a square is not something we can undo, so do those last.
+	sort.SliceStable(todo, func(a, b int) bool {
+		if todo[a].square != todo[b].square {
+			return !todo[a].square
+		}
+		return todo[a].size > todo[b].size
+	})
 
-	if err := image.Crop(geometry); err != nil {
-		_ = image.Destroy()
-		return fmt.Errorf("unable to crop: %s: %s", i.Filename, err)
+	image, err := i.decode(proc)
+	if err != nil {
+		return nil, err
 	}
 
-	image.PlusRepage()
+	var created []string
 
-	if err := image.ToFile(resizeFile); err != nil {
-		_ = image.Destroy()
-		return fmt.Errorf("unable to save resized image: %s: %s", resizeFile, err)
-	}
+	// Whether image is still the original, or whether we've shrunk it.
+	resized := false
 
-	if err := image.Destroy(); err != nil {
-		return fmt.Errorf("unable to clean up: %s", err)
+	for _, d := range todo {
+		if verbose {
+			logger.Printf("Creating image %s...", d.path)
+		}
+
+		width, height := d.dimensions(image.Width(), image.Height())
+
+		// Normally we resize from the previous derivative. If it is too small to
+		// make this one from (such as with panoramas), go back to the original.
+		if resized && (width > image.Width() || height > image.Height()) {
+			if err := image.Close(); err != nil {
+				return created, fmt.Errorf("unable to clean up: %s", err)
+			}
+
+			image, err = i.decode(proc)
+			if err != nil {
+				return created, err
+			}
+			resized = false
+
+			width, height = d.dimensions(image.Width(), image.Height())
+		}
+
+		// make() resizes image in place, so decide this first.
+		if width != image.Width() || height != image.Height() || d.square {
+			resized = true
+		}
+
+		if err := d.make(image, width, height, lock); err != nil {
+			_ = image.Close()
+			return created, fmt.Errorf("%s: %s", i.Filename, err)
+		}
+		created = append(created, d.path)
+
+		d.set(d.path)
 	}
 
-	i.ThumbnailPath = resizeFile
-	i.ThumbnailFilename = filepath.Base(resizeFile)
+	if err := image.Close(); err != nil {
+		return created, fmt.Errorf("unable to clean up: %s", err)
+	}
 
-	return nil
+	return created, nil
 }
 
-// Make a large version of the image. It is still shrunken from the original in
-// most cases.
-func (i *Image) makeLargeImage(dir string, verbose, forceGenerate bool) error {
-	resizeFile, err := i.getResizedFilename(dir, i.LargeImageSize, -1)
+// bytesPerPixel is roughly how much memory a decoded image needs per pixel.
+// ImageMagick (at Q16) stores 4 channels of 16 bits each.
+const bytesPerPixel = 8
+
+// pixelsPerByte is our guess at the number of pixels per byte of file when we
+// can't read an image's dimensions without decoding it (such as with HEIC and
+// RAW formats). Compressed formats tend to be well under one byte per pixel.
+const pixelsPerByte = 4
+
+// memoryEstimate estimates the memory in bytes needed to generate the image's
+// resized versions.
+//
+// It is 0 if there is nothing to generate.
+func (i *Image) memoryEstimate(dir string, forceGenerate bool) (int64,
+	error) {
+	derivatives, err := i.derivatives(dir)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	if !forceGenerate {
-		// If the resized version exists, nothing to do.
-		if _, err = os.Stat(resizeFile); err == nil {
-			i.LargeImagePath = resizeFile
-			i.LargeImageFilename = filepath.Base(resizeFile)
-			return nil
+		missing := false
+		for _, d := range derivatives {
+			exists, err := fileExists(d.path)
+			if err != nil {
+				return 0, fmt.Errorf("stat: %s %s", d.path, err)
+			}
+			if !exists {
+				missing = true
+				break
+			}
+		}
+
+		if !missing {
+			return 0, nil
 		}
+	}
+
+	return i.decodeMemoryEstimate()
+}
+
+// decodeMemoryEstimate estimates the memory in bytes needed to hold the
+// decoded original image.
+func (i *Image) decodeMemoryEstimate() (int64, error) {
+	fh, err := os.Open(i.Path)
+	if err != nil {
+		return 0, err
+	}
 
-		if !os.IsNotExist(err) {
-			return fmt.Errorf("stat: %s %s", resizeFile, err)
+	config, _, err := image.DecodeConfig(fh)
+	if err == nil {
+		if err := fh.Close(); err != nil {
+			return 0, fmt.Errorf("close: %s", err)
 		}
+		return int64(config.Width) * int64(config.Height) * bytesPerPixel, nil
 	}
 
-	if verbose {
-		log.Printf("Creating image %s...", resizeFile)
+	fi, err := fh.Stat()
+	if err != nil {
+		_ = fh.Close()
+		return 0, err
+	}
+
+	if err := fh.Close(); err != nil {
+		return 0, fmt.Errorf("close: %s", err)
 	}
 
-	image, err := magick.NewFromFile(i.Path)
+	return fi.Size() * pixelsPerByte * bytesPerPixel, nil
+}
+
+// decode reads the original image and orients it.
+func (i *Image) decode(proc ImageProcessor) (ProcessedImage, error) {
+	image, err := proc.Decode(i.Path)
 	if err != nil {
-		return fmt.Errorf("unable to open image: %s: %s", i.Filename, err)
+		return nil, fmt.Errorf("unable to open image: %s: %s", i.Filename, err)
 	}
 
 	if err := image.AutoOrient(); err != nil {
-		_ = image.Destroy()
-		return fmt.Errorf("unable to auto orient: %s: %s", i.Filename, err)
+		_ = image.Close()
+		return nil, fmt.Errorf("unable to auto orient: %s: %s", i.Filename, err)
 	}
 
-	// May not need to resize.
-	if image.Width() > i.LargeImageSize || image.Height() > i.LargeImageSize {
-		if image.Width() > image.Height() {
-			if err := image.Resize(fmt.Sprintf("%dx", i.LargeImageSize)); err != nil {
-				_ = image.Destroy()
-				return fmt.Errorf("unable to resize image: %s: %s", i.Filename, err)
-			}
-		} else {
-			if err := image.Resize(fmt.Sprintf("x%d", i.LargeImageSize)); err != nil {
-				_ = image.Destroy()
-				return fmt.Errorf("unable to resize image: %s: %s", i.Filename, err)
-			}
+	return image, nil
+}
+
+// make resizes the image to the given dimensions, crops it if the derivative
+// is square, and writes it out.
+//
+// If the derivative is square, the dimensions must be those we crop from. We
+// crop from the centre.
+//
+// If lock is set, we encrypt what we write with it.
+func (d *derivative) make(image ProcessedImage, width, height int,
+	lock *albumLock) error {
+	if width != image.Width() || height != image.Height() {
+		if err := image.Resize(width, height); err != nil {
+			return fmt.Errorf("unable to resize image: %s", err)
 		}
 	}
 
-	if err := image.ToFile(resizeFile); err != nil {
-		_ = image.Destroy()
-		return fmt.Errorf("unable to save resized image: %s: %s", resizeFile, err)
-	}
+	if d.square {
+		xOffset := (image.Width() - d.size) / 2
+		yOffset := (image.Height() - d.size) / 2
 
-	if err := image.Destroy(); err != nil {
-		return fmt.Errorf("unable to clean up: %s", err)
+		if err := image.Crop(xOffset, yOffset, d.size, d.size); err != nil {
+			return fmt.Errorf("unable to crop: %s", err)
+		}
 	}
 
-	i.LargeImagePath = resizeFile
-	i.LargeImageFilename = filepath.Base(resizeFile)
+	if err := createFileAtomic(d.path, func(tmpPath string) error {
+		if err := image.Encode(tmpPath); err != nil {
+			return err
+		}
+		if lock != nil {
+			return encryptFile(tmpPath, lock.key)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("unable to save resized image: %s: %s", d.path, err)
+	}
 
 	return nil
 }
 
+// scaleToFit returns the dimensions of an image scaled so that its longest
+// side is size, keeping its aspect ratio.
+func scaleToFit(width, height, size int) (int, int) {
+	if width > height {
+		return size, scaleSide(height, size, width)
+	}
+	return scaleSide(width, size, height), size
+}
+
+// scaleToCover returns the dimensions of an image scaled so that its shortest
+// side is size, keeping its aspect ratio.
+func scaleToCover(width, height, size int) (int, int) {
+	if width > height {
+		return scaleSide(width, size, height), size
+	}
+	return size, scaleSide(height, size, width)
+}
+
+// scaleSide scales side by num/denom, rounding, and never going below 1.
+func scaleSide(side, num, denom int) int {
+	scaled := (side*num + denom/2) / denom
+	if scaled < 1 {
+		return 1
+	}
+	return scaled
+}
+
 // getResizedFilename decides the path to the file with the given width/height.
 func (i Image) getResizedFilename(dir string, width,
 	height int) (string, error) {
@@ -234,6 +451,14 @@ func (i Image) getResizedFilename(dir string, width,
 	prefix := strings.Join(namePieces[:len(namePieces)-1], ".")
 	suffix := namePieces[len(namePieces)-1]
 
+	// Browsers can't display formats like HEIC or RAW, so the resized versions
+	// are always JPEGs. We keep the original extension in the name, as with
+	// convertedFilename().
+	if i.needsConversion() {
+		prefix = i.Filename
+		suffix = "jpg"
+	}
+
 	// -1 if the width/height is auto. Width/height will be width depending on
 	// which is larger.
 	newName := ""
@@ -245,3 +470,28 @@ func (i Image) getResizedFilename(dir string, width,
 
 	return filepath.Join(dir, newName), nil
 }
+
+// convertToJPEG decodes the image at src, orients it, and writes it out as a
+// JPEG to dest. We write dest atomically.
+func convertToJPEG(proc ImageProcessor, src, dest string) error {
+	image, err := proc.Decode(src)
+	if err != nil {
+		return fmt.Errorf("unable to open image: %s: %s", src, err)
+	}
+
+	if err := image.AutoOrient(); err != nil {
+		_ = image.Close()
+		return fmt.Errorf("unable to auto orient: %s: %s", src, err)
+	}
+
+	if err := createFileAtomic(dest, image.Encode); err != nil {
+		_ = image.Close()
+		return fmt.Errorf("unable to save converted image: %s: %s", dest, err)
+	}
+
+	if err := image.Close(); err != nil {
+		return fmt.Errorf("unable to clean up: %s", err)
+	}
+
+	return nil
+}
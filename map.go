@@ -0,0 +1,461 @@
+package gallery
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Location is where an image was taken.
+type Location struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// The defaults for the map's tiles. Refer to Gallery.MapTileURL.
+const (
+	defaultMapTileURL     = "https://tile.openstreetmap.org/{z}/{x}/{y}.png"
+	defaultMapAttribution = "© OpenStreetMap contributors"
+)
+
+// The filenames of a map page and its GeoJSON.
+const (
+	mapPageFilename    = "map.html"
+	mapGeoJSONFilename = "map.geojson"
+)
+
+// ParseLocation parses a location written as latitude and longitude in
+// decimal degrees, such as "49.2827, -123.1207".
+func ParseLocation(s string) (*Location, error) {
+	pieces := strings.Split(s, ",")
+	if len(pieces) != 2 {
+		return nil, fmt.Errorf("location must be latitude, longitude: %s", s)
+	}
+
+	lat, err := strconv.ParseFloat(strings.TrimSpace(pieces[0]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid latitude: %s", pieces[0])
+	}
+
+	lon, err := strconv.ParseFloat(strings.TrimSpace(pieces[1]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid longitude: %s", pieces[1])
+	}
+
+	location := &Location{Latitude: lat, Longitude: lon}
+	if !location.valid() {
+		return nil, fmt.Errorf("location out of range: %s", s)
+	}
+
+	return location, nil
+}
+
+func (l Location) String() string {
+	return fmt.Sprintf("%.6f, %.6f", l.Latitude, l.Longitude)
+}
+
+// valid tells us whether the location is on Earth. We also reject 0, 0 as
+// some cameras write that when they don't know where they are.
+func (l Location) valid() bool {
+	if math.IsNaN(l.Latitude) || math.IsNaN(l.Longitude) {
+		return false
+	}
+
+	if l.Latitude < -90 || l.Latitude > 90 || l.Longitude < -180 ||
+		l.Longitude > 180 {
+		return false
+	}
+
+	return l.Latitude != 0 || l.Longitude != 0
+}
+
+// mapTileURL returns the URL template for map tiles, using the default if
+// none is set.
+func mapTileURL(tileURL string) string {
+	if tileURL == "" {
+		return defaultMapTileURL
+	}
+	return tileURL
+}
+
+// mapAttribution returns the attribution for map tiles. If we're using the
+// default tiles, we use their attribution unless one is set.
+func mapAttribution(tileURL, attribution string) string {
+	if tileURL == "" && attribution == "" {
+		return defaultMapAttribution
+	}
+	return attribution
+}
+
+// readLocation reads where an image was taken from its EXIF data. It returns
+// nil if it doesn't say.
+func readLocation(path string) (*Location, error) {
+	data, err := readExif(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return data.Location, nil
+}
+
+// removeMapHTML removes the map page and its GeoJSON from the directory, if
+// they are there.
+func removeMapHTML(dir string) error {
+	for _, filename := range []string{mapPageFilename, mapGeoJSONFilename} {
+		err := os.Remove(filepath.Join(dir, filename))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove map: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// geoJSONFeature is an image as a GeoJSON feature.
+type geoJSONFeature struct {
+	Type       string            `json:"type"`
+	Geometry   geoJSONPoint      `json:"geometry"`
+	Properties geoJSONProperties `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type string `json:"type"`
+
+	// Longitude then latitude.
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// geoJSONProperties says which image a feature is. The URLs are relative to
+// the map page.
+type geoJSONProperties struct {
+	Name     string `json:"name"`
+	Album    string `json:"album"`
+	URL      string `json:"url"`
+	ThumbURL string `json:"thumb_url"`
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+// mapFeatures returns a feature for each chosen image that we know the
+// location of. dir is the path from the map page to the album. It is blank
+// if the page is in the album.
+func (a *Album) mapFeatures(dir string) []geoJSONFeature {
+	features := []geoJSONFeature{}
+
+	for i, image := range a.chosenImages {
+		if image.Location == nil {
+			continue
+		}
+
+		features = append(features, geoJSONFeature{
+			Type: "Feature",
+			Geometry: geoJSONPoint{
+				Type: "Point",
+				Coordinates: [2]float64{image.Location.Longitude,
+					image.Location.Latitude},
+			},
+			Properties: geoJSONProperties{
+				Name:     image.Filename,
+				Album:    a.Name,
+				URL:      dir + imagePageFilename(i),
+				ThumbURL: dir + image.ThumbnailFilename,
+			},
+		})
+	}
+
+	return features
+}
+
+// mapPage holds what we show on a map page.
+type mapPage struct {
+	Title   string
+	BackURL string
+
+	// Where BackURL goes.
+	BackName string
+
+	Features []geoJSONFeature
+
+	TileURL     string
+	Attribution string
+}
+
+// makeMapHTML writes a map page showing where images were taken, along with
+// the same as GeoJSON. Each marker links to its image's page.
+//
+// The map loads tiles from the page's TileURL. We don't use a map library so
+// that the page works without loading anything from elsewhere other than the
+// tiles.
+func makeMapHTML(dir string, page mapPage, style template.CSS,
+	baseURL string, logger *log.Logger, verbose, forceGenerate bool) (bool,
+	error) {
+	htmlPath := filepath.Join(dir, mapPageFilename)
+	exists, err := fileExists(htmlPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if HTML exists: %s: %s", htmlPath, err)
+	}
+
+	if !forceGenerate && exists {
+		return false, nil
+	}
+
+	geoJSONPath := filepath.Join(dir, mapGeoJSONFilename)
+	if err := writeFileAtomic(geoJSONPath, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(geoJSONFeatureCollection{
+			Type:     "FeatureCollection",
+			Features: page.Features,
+		})
+	}); err != nil {
+		return false, fmt.Errorf("unable to write GeoJSON: %s", err)
+	}
+
+	t, err := template.New("page").Parse(mapTemplate)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse HTML template: %s", err)
+	}
+
+	data := struct {
+		mapPage
+		CSS template.CSS
+		URL string
+	}{
+		mapPage: page,
+		CSS:     style,
+		URL:     pageURL(baseURL, mapPageFilename),
+	}
+
+	if err := writeTemplate(htmlPath, t, data); err != nil {
+		return false, err
+	}
+
+	if verbose {
+		logger.Printf("Wrote HTML file: %s", htmlPath)
+	}
+	return true, nil
+}
+
+// The map shows the tiles around the markers at a zoom level where they all
+// fit. You can drag it around and zoom in and out.
+const mapTemplate = `<!DOCTYPE html>
+<meta charset="utf-8">
+<title>Map - {{.Title}}</title>
+<meta name="viewport" content="width=device-width, user-scalable=no">
+<style>{{.CSS}}</style>
+{{if .URL}}<link rel="canonical" href="{{.URL}}">{{end}}
+<style>
+#map {
+	position: relative;
+	overflow: hidden;
+	height: 70vh;
+	margin: 0 50px 15px 50px;
+	background: #ddd;
+	cursor: grab;
+	touch-action: none;
+}
+
+#map img.tile {
+	position: absolute;
+	width: 256px;
+	height: 256px;
+	max-width: none;
+}
+
+#map a.marker {
+	position: absolute;
+	width: 14px;
+	height: 14px;
+	margin: -7px 0 0 -7px;
+	border: 2px solid #fff;
+	border-radius: 50%;
+	background: #c00;
+}
+
+#zoom {
+	position: absolute;
+	top: 10px;
+	left: 10px;
+	z-index: 1;
+}
+
+#attribution {
+	position: absolute;
+	right: 0;
+	bottom: 0;
+	z-index: 1;
+	padding: 0 4px;
+	background: rgba(255, 255, 255, 0.7);
+	color: #333;
+	font-size: 0.8em;
+}
+</style>
+<h1>Map - {{.Title}}</h1>
+
+<div id="nav">
+	Navigation:
+	<a href="{{.BackURL}}">Back to {{.BackName}}</a> |
+	<a href="map.geojson">GeoJSON</a>
+</div>
+
+{{if not .Features}}
+<p>No images say where they were taken.</p>
+{{end}}
+
+<div id="map">
+	<div id="zoom">
+		<button id="zoom-in">+</button>
+		<button id="zoom-out">-</button>
+	</div>
+	<div id="layer"></div>
+	<div id="attribution">{{.Attribution}}</div>
+</div>
+
+<script>
+"use strict";
+
+var features = {{.Features}};
+var tileURL = {{.TileURL}};
+
+var mapEl = document.getElementById("map");
+var layer = document.getElementById("layer");
+
+var zoom = 2;
+var center = {x: 512, y: 512};
+
+// Project to pixels in the map at the zoom level.
+function project(lon, lat, z) {
+	var size = 256 * Math.pow(2, z);
+	var sin = Math.sin(lat * Math.PI / 180);
+	sin = Math.min(Math.max(sin, -0.9999), 0.9999);
+	return {
+		x: (lon + 180) / 360 * size,
+		y: (0.5 - Math.log((1 + sin) / (1 - sin)) / (4 * Math.PI)) * size
+	};
+}
+
+// Choose the highest zoom at which all markers fit.
+function fit() {
+	if (features.length === 0) {
+		return;
+	}
+
+	var width = mapEl.clientWidth - 40;
+	var height = mapEl.clientHeight - 40;
+
+	for (var z = 16; z >= 0; z--) {
+		var minX = Infinity, minY = Infinity, maxX = -Infinity, maxY = -Infinity;
+		features.forEach(function(f) {
+			var p = project(f.geometry.coordinates[0], f.geometry.coordinates[1], z);
+			minX = Math.min(minX, p.x);
+			minY = Math.min(minY, p.y);
+			maxX = Math.max(maxX, p.x);
+			maxY = Math.max(maxY, p.y);
+		});
+
+		if (maxX - minX <= width && maxY - minY <= height || z === 0) {
+			zoom = z;
+			center = {x: (minX + maxX) / 2, y: (minY + maxY) / 2};
+			return;
+		}
+	}
+}
+
+function render() {
+	var width = mapEl.clientWidth;
+	var height = mapEl.clientHeight;
+	var left = center.x - width / 2;
+	var top = center.y - height / 2;
+	var tiles = Math.pow(2, zoom);
+
+	layer.textContent = "";
+
+	for (var tx = Math.floor(left / 256); tx * 256 < left + width; tx++) {
+		for (var ty = Math.floor(top / 256); ty * 256 < top + height; ty++) {
+			if (ty < 0 || ty >= tiles) {
+				continue;
+			}
+
+			var x = ((tx % tiles) + tiles) % tiles;
+			var img = document.createElement("img");
+			img.className = "tile";
+			img.alt = "";
+			img.src = tileURL.replace("{z}", zoom).replace("{x}", x)
+				.replace("{y}", ty);
+			img.style.left = (tx * 256 - left) + "px";
+			img.style.top = (ty * 256 - top) + "px";
+			layer.appendChild(img);
+		}
+	}
+
+	features.forEach(function(f) {
+		var p = project(f.geometry.coordinates[0], f.geometry.coordinates[1],
+			zoom);
+		var a = document.createElement("a");
+		a.className = "marker";
+		a.href = f.properties.url;
+		a.title = f.properties.album + ": " + f.properties.name;
+		a.style.left = (p.x - left) + "px";
+		a.style.top = (p.y - top) + "px";
+		layer.appendChild(a);
+	});
+}
+
+function setZoom(z) {
+	z = Math.min(Math.max(z, 0), 19);
+	var scale = Math.pow(2, z - zoom);
+	center = {x: center.x * scale, y: center.y * scale};
+	zoom = z;
+	render();
+}
+
+document.getElementById("zoom-in").addEventListener("click", function() {
+	setZoom(zoom + 1);
+});
+
+document.getElementById("zoom-out").addEventListener("click", function() {
+	setZoom(zoom - 1);
+});
+
+var drag = null;
+
+mapEl.addEventListener("pointerdown", function(evt) {
+	if (evt.target.tagName === "A" || evt.target.tagName === "BUTTON") {
+		return;
+	}
+	drag = {x: evt.clientX, y: evt.clientY};
+	mapEl.setPointerCapture(evt.pointerId);
+});
+
+mapEl.addEventListener("pointermove", function(evt) {
+	if (!drag) {
+		return;
+	}
+	center = {
+		x: center.x - (evt.clientX - drag.x),
+		y: center.y - (evt.clientY - drag.y)
+	};
+	drag = {x: evt.clientX, y: evt.clientY};
+	render();
+});
+
+mapEl.addEventListener("pointerup", function() {
+	drag = null;
+});
+
+window.addEventListener("resize", render);
+
+fit();
+render();
+</script>
+`
@@ -0,0 +1,476 @@
+package gallery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// imageMetadata holds what the image file says about itself, such as a
+// caption a photo manager stored in it.
+type imageMetadata struct {
+	Description string
+	Keywords    []string
+
+	// Star rating from 1 to 5. 0 if not rated. -1 if rejected.
+	Rating int
+}
+
+// Namespaces of the XMP properties we look at.
+const (
+	xmpNamespaceDC  = "http://purl.org/dc/elements/1.1/"
+	xmpNamespaceRDF = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	xmpNamespaceXMP = "http://ns.adobe.com/xap/1.0/"
+)
+
+// IPTC datasets we look at. These are in record 2.
+const (
+	iptcKeywords = 25
+	iptcCaption  = 120
+)
+
+// The prefixes of the JPEG segments holding XMP (APP1) and IPTC (APP13).
+var (
+	jpegXMPPrefix       = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegPhotoshopPrefix = []byte("Photoshop 3.0\x00")
+)
+
+// cameraDescriptions are descriptions cameras put in the EXIF
+// ImageDescription on their own. These aren't captions.
+var cameraDescriptions = map[string]bool{
+	"OLYMPUS DIGITAL CAMERA":     true,
+	"SONY DSC":                   true,
+	"DIGITAL CAMERA":             true,
+	"KODAK Digital Still Camera": true,
+}
+
+// readImageMetadata reads the caption, keywords, and rating of an image.
+//
+// Photo managers store these in several places. From most to least preferred:
+//
+//   - An XMP sidecar file, such as IMG_1.jpg.xmp (darktable) or IMG_1.xmp
+//     (Lightroom).
+//   - XMP in the image (dc:description, dc:subject, xmp:Rating).
+//   - IPTC in the image (Caption-Abstract, Keywords).
+//   - EXIF in the image (ImageDescription).
+//
+// We take each field from the most preferred place that has it. We read XMP
+// from any image, and IPTC only from JPEGs. If there is none of these, we
+// return an empty imageMetadata and no error.
+func readImageMetadata(path string) (*imageMetadata, error) {
+	exif, err := readExif(path)
+	if err != nil {
+		return nil, err
+	}
+
+	xmpPacket, iptc, err := readMetadataBlocks(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &imageMetadata{}
+
+	if !cameraDescriptions[exif.Description] {
+		data.Description = exif.Description
+	}
+
+	if iptc != nil {
+		data.merge(parseIPTC(iptc))
+	}
+
+	if xmpPacket != nil {
+		xmpData, err := parseXMP(xmpPacket)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		data.merge(xmpData)
+	}
+
+	sidecar, err := findSidecar(path)
+	if err != nil {
+		return nil, err
+	}
+	if sidecar != "" {
+		buf, err := os.ReadFile(sidecar)
+		if err != nil {
+			return nil, err
+		}
+
+		sidecarData, err := parseXMP(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", sidecar, err)
+		}
+		data.merge(sidecarData)
+	}
+
+	return data, nil
+}
+
+// merge sets the fields that other has.
+func (m *imageMetadata) merge(other *imageMetadata) {
+	if other.Description != "" {
+		m.Description = other.Description
+	}
+	if len(other.Keywords) > 0 {
+		m.Keywords = other.Keywords
+	}
+	if other.Rating != 0 {
+		m.Rating = other.Rating
+	}
+}
+
+// apply fills in an image's description and rating from the metadata if it
+// doesn't have them, and adds the keywords to its tags. A rating becomes a tag
+// too, such as rating-5.
+func (m *imageMetadata) apply(image *Image) {
+	if image.Description == "" {
+		image.Description = m.Description
+	}
+
+	if image.Rating == 0 {
+		image.Rating = m.Rating
+	}
+
+	for _, tag := range m.Keywords {
+		if !image.hasTag(tag) {
+			image.Tags = append(image.Tags, tag)
+		}
+	}
+
+	if m.Rating > 0 {
+		tag := fmt.Sprintf("rating-%d", m.Rating)
+		if !image.hasTag(tag) {
+			image.Tags = append(image.Tags, tag)
+		}
+	}
+}
+
+// findSidecar returns the path to the image's XMP sidecar file. It returns a
+// blank string if there is none.
+func findSidecar(path string) (string, error) {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+
+	candidates := []string{
+		path + ".xmp",
+		path + ".XMP",
+		base + ".xmp",
+		base + ".XMP",
+	}
+
+	for _, candidate := range candidates {
+		exists, err := fileExists(candidate)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return candidate, nil
+		}
+	}
+
+	return "", nil
+}
+
+// readMetadataBlocks finds the XMP packet and IPTC data in an image. Either
+// is nil if the image doesn't have it.
+//
+// In a JPEG, these are in their own segments. In other formats, we look for
+// an XMP packet near the start of the file.
+func readMetadataBlocks(path string) ([]byte, []byte, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := make([]byte, 4)
+	n, err := io.ReadFull(fh, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		_ = fh.Close()
+		return nil, nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	var xmpPacket, iptc []byte
+
+	if n == 4 && header[0] == 0xff && header[1] == 0xd8 {
+		xmpPacket, iptc, err = readJPEGMetadata(fh, header[3])
+	} else {
+		var head []byte
+		head, err = io.ReadAll(io.LimitReader(fh, maxTIFFRead))
+		xmpPacket = findXMPPacket(append(header[:n], head...))
+	}
+	if err != nil {
+		_ = fh.Close()
+		return nil, nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if err := fh.Close(); err != nil {
+		return nil, nil, fmt.Errorf("close: %s", err)
+	}
+
+	return xmpPacket, iptc, nil
+}
+
+// readJPEGMetadata walks the segments of a JPEG looking for XMP and IPTC.
+// marker is the first marker, which the caller read along with the header.
+func readJPEGMetadata(r io.Reader, marker byte) ([]byte, []byte, error) {
+	br := &byteReader{r: r}
+
+	var xmpPacket, iptc []byte
+
+	for {
+		// SOS. Image data follows. There is no metadata after this.
+		if marker == 0xda || marker == 0xd9 {
+			return xmpPacket, iptc, nil
+		}
+
+		length, err := br.uint16()
+		if err != nil {
+			// A truncated file. Use what we found.
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return xmpPacket, iptc, nil
+			}
+			return nil, nil, err
+		}
+		if length < 2 {
+			return nil, nil, fmt.Errorf("invalid JPEG segment length")
+		}
+
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return xmpPacket, iptc, nil
+			}
+			return nil, nil, err
+		}
+
+		if marker == 0xe1 && xmpPacket == nil &&
+			bytes.HasPrefix(segment, jpegXMPPrefix) {
+			xmpPacket = segment[len(jpegXMPPrefix):]
+		}
+
+		if marker == 0xed && iptc == nil &&
+			bytes.HasPrefix(segment, jpegPhotoshopPrefix) {
+			iptc = findPhotoshopIPTC(segment[len(jpegPhotoshopPrefix):])
+		}
+
+		m, err := br.marker()
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return xmpPacket, iptc, nil
+			}
+			return nil, nil, err
+		}
+		marker = m
+	}
+}
+
+// findXMPPacket finds an XMP packet in a file's bytes. It returns nil if
+// there is none.
+func findXMPPacket(data []byte) []byte {
+	start := bytes.Index(data, []byte("<x:xmpmeta"))
+	if start == -1 {
+		return nil
+	}
+
+	end := bytes.Index(data[start:], []byte("</x:xmpmeta>"))
+	if end == -1 {
+		return nil
+	}
+
+	return data[start : start+end+len("</x:xmpmeta>")]
+}
+
+// findPhotoshopIPTC finds the IPTC data in Photoshop image resources, as
+// found in a JPEG's APP13 segment. It returns nil if there is none.
+func findPhotoshopIPTC(data []byte) []byte {
+	for len(data) >= 12 && bytes.HasPrefix(data, []byte("8BIM")) {
+		id := binary.BigEndian.Uint16(data[4:6])
+
+		// A Pascal string name, padded so its length is even.
+		nameLength := int(data[6]) + 1
+		if nameLength%2 == 1 {
+			nameLength++
+		}
+
+		offset := 6 + nameLength
+		if offset+4 > len(data) {
+			return nil
+		}
+
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		offset += 4
+		if size < 0 || offset+size > len(data) {
+			return nil
+		}
+
+		// IPTC-NAA record.
+		if id == 0x0404 {
+			return data[offset : offset+size]
+		}
+
+		// Data is padded so its length is even too.
+		if size%2 == 1 {
+			size++
+		}
+		if offset+size > len(data) {
+			return nil
+		}
+		data = data[offset+size:]
+	}
+
+	return nil
+}
+
+// parseIPTC parses the fields we want from IPTC datasets.
+func parseIPTC(data []byte) *imageMetadata {
+	md := &imageMetadata{}
+
+	for len(data) >= 5 && data[0] == 0x1c {
+		record := data[1]
+		dataset := data[2]
+		size := int(binary.BigEndian.Uint16(data[3:5]))
+
+		// Extended sizes. These are for large binary data, not fields we want.
+		if size&0x8000 != 0 {
+			return md
+		}
+
+		if 5+size > len(data) {
+			return md
+		}
+		value := iptcString(data[5 : 5+size])
+		data = data[5+size:]
+
+		if record != 2 {
+			continue
+		}
+
+		switch dataset {
+		case iptcCaption:
+			md.Description = value
+		case iptcKeywords:
+			if value != "" {
+				md.Keywords = append(md.Keywords, value)
+			}
+		}
+	}
+
+	return md
+}
+
+// iptcString decodes an IPTC string. Older files often use Latin-1 rather
+// than UTF-8, so if it isn't valid UTF-8 we assume Latin-1.
+func iptcString(b []byte) string {
+	if utf8.Valid(b) {
+		return strings.TrimSpace(string(b))
+	}
+
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+
+	return strings.TrimSpace(string(runes))
+}
+
+// parseXMP parses the fields we want from an XMP packet.
+//
+// dc:description is a language alternative. We use the x-default entry, or
+// the first if there is none. dc:subject is a bag of keywords. xmp:Rating may
+// be an attribute or an element.
+func parseXMP(packet []byte) (*imageMetadata, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(packet))
+
+	md := &imageMetadata{}
+
+	// The dc property we're inside, if any.
+	property := ""
+	foundDescription := false
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return md, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid XMP: %s", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Space == xmpNamespaceDC &&
+				(t.Name.Local == "description" || t.Name.Local == "subject") {
+				property = t.Name.Local
+				continue
+			}
+
+			if t.Name.Space == xmpNamespaceRDF && t.Name.Local == "Description" {
+				for _, attr := range t.Attr {
+					if attr.Name.Space == xmpNamespaceXMP &&
+						attr.Name.Local == "Rating" {
+						md.Rating = parseXMPRating(attr.Value)
+					}
+				}
+				continue
+			}
+
+			if t.Name.Space == xmpNamespaceXMP && t.Name.Local == "Rating" {
+				var text string
+				if err := decoder.DecodeElement(&text, &t); err != nil {
+					return nil, fmt.Errorf("invalid XMP: %s", err)
+				}
+				md.Rating = parseXMPRating(text)
+				continue
+			}
+
+			if property != "" && t.Name.Space == xmpNamespaceRDF &&
+				t.Name.Local == "li" {
+				defaultLang := false
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "lang" && attr.Value == "x-default" {
+						defaultLang = true
+					}
+				}
+
+				var text string
+				if err := decoder.DecodeElement(&text, &t); err != nil {
+					return nil, fmt.Errorf("invalid XMP: %s", err)
+				}
+				text = strings.TrimSpace(text)
+				if text == "" {
+					continue
+				}
+
+				if property == "description" && (!foundDescription || defaultLang) {
+					md.Description = text
+					foundDescription = true
+				}
+
+				if property == "subject" {
+					md.Keywords = append(md.Keywords, text)
+				}
+			}
+		case xml.EndElement:
+			if t.Name.Space == xmpNamespaceDC && t.Name.Local == property {
+				property = ""
+			}
+		}
+	}
+}
+
+// parseXMPRating parses an xmp:Rating. It is a number from -1 (rejected) to 5.
+// Some programs write it as a real number. We return 0 if it is not valid.
+func parseXMPRating(value string) int {
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || f < -1 || f > 5 {
+		return 0
+	}
+
+	return int(f)
+}
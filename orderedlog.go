@@ -0,0 +1,73 @@
+package gallery
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"sync"
+)
+
+// orderedLog lets several albums log at once while keeping each album's
+// messages together, and the albums in order.
+//
+// The first album that is not yet done logs straight through. We buffer the
+// messages of the others until it is their turn.
+type orderedLog struct {
+	out io.Writer
+
+	mutex   sync.Mutex
+	buffers []bytes.Buffer
+	done    []bool
+
+	// The album logging straight through.
+	head int
+}
+
+// orderedLogWriter is an io.Writer for one album's messages.
+type orderedLogWriter struct {
+	log   *orderedLog
+	index int
+}
+
+func newOrderedLog(out io.Writer, count int) *orderedLog {
+	return &orderedLog{
+		out:     out,
+		buffers: make([]bytes.Buffer, count),
+		done:    make([]bool, count),
+	}
+}
+
+// logger returns a logger for the album at the given index. It uses the
+// standard logger's prefix and flags.
+func (l *orderedLog) logger(index int) *log.Logger {
+	return log.New(orderedLogWriter{log: l, index: index}, log.Prefix(),
+		log.Flags())
+}
+
+func (w orderedLogWriter) Write(p []byte) (int, error) {
+	w.log.mutex.Lock()
+	defer w.log.mutex.Unlock()
+
+	if w.index == w.log.head {
+		return w.log.out.Write(p)
+	}
+
+	return w.log.buffers[w.index].Write(p)
+}
+
+// finish records that the album at the given index is done logging. If it was
+// logging straight through, we output the messages of the albums following it.
+func (l *orderedLog) finish(index int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.done[index] = true
+
+	for l.head < len(l.done) && l.done[l.head] {
+		l.head++
+		if l.head < len(l.done) {
+			_, _ = l.out.Write(l.buffers[l.head].Bytes())
+			l.buffers[l.head].Reset()
+		}
+	}
+}
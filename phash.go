@@ -0,0 +1,82 @@
+package gallery
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+)
+
+// The size we shrink images to when hashing them. We compare each pixel with
+// the one to its right, so there is one more column than bits per row.
+const (
+	hashWidth  = 9
+	hashHeight = 8
+)
+
+// PerceptualHash computes a hash of the image at the given path that is the
+// same or close for images that look alike. This is the case even if they
+// differ in size, format, or compression. Compare hashes with
+// HashDistance().
+//
+// This is a difference hash: We shrink the image to 9x8 and record for each
+// pixel whether it is brighter than the one to its right.
+func PerceptualHash(proc ImageProcessor, path string) (uint64, error) {
+	img, err := proc.Decode(path)
+	if err != nil {
+		return 0, fmt.Errorf("unable to decode: %s: %s", path, err)
+	}
+
+	if err := img.AutoOrient(); err != nil {
+		_ = img.Close()
+		return 0, fmt.Errorf("unable to auto orient: %s: %s", path, err)
+	}
+
+	if err := img.Resize(hashWidth, hashHeight); err != nil {
+		_ = img.Close()
+		return 0, fmt.Errorf("unable to resize: %s: %s", path, err)
+	}
+
+	small, err := img.Pixels()
+	if err != nil {
+		_ = img.Close()
+		return 0, fmt.Errorf("unable to get pixels: %s: %s", path, err)
+	}
+
+	hash := differenceHash(small)
+
+	if err := img.Close(); err != nil {
+		return 0, fmt.Errorf("unable to close image: %s", err)
+	}
+
+	return hash, nil
+}
+
+// differenceHash computes the hash of an image that is already 9x8.
+func differenceHash(img image.Image) uint64 {
+	bounds := img.Bounds()
+
+	var hash uint64
+	for y := 0; y < hashHeight; y++ {
+		for x := 0; x < hashWidth-1; x++ {
+			left := color.GrayModel.Convert(
+				img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray)
+			right := color.GrayModel.Convert(
+				img.At(bounds.Min.X+x+1, bounds.Min.Y+y)).(color.Gray)
+
+			hash <<= 1
+			if left.Y > right.Y {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
+
+// HashDistance returns how many bits differ between two hashes from
+// PerceptualHash(). 0 means the images look the same, or nearly so. Unrelated
+// images typically differ in around half the bits.
+func HashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
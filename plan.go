@@ -0,0 +1,275 @@
+package gallery
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// PlanAction says what installing would do with a file.
+type PlanAction int
+
+// The PlanActions.
+const (
+	// The file does not exist. We would create it.
+	PlanCreate PlanAction = iota
+
+	// The file exists, but we would create it again because we're forced to.
+	PlanRegenerate
+
+	// The file exists and we would leave it alone.
+	PlanKeep
+)
+
+// PlanKind says what sort of file a PlannedFile is.
+type PlanKind int
+
+// The PlanKinds.
+const (
+	PlanThumbnail PlanKind = iota
+	PlanLargeImage
+	PlanOriginal
+	PlanPage
+	PlanZip
+)
+
+// PlannedFile is a file that installing would output.
+type PlannedFile struct {
+	// Album the file is in. Blank for the gallery index page.
+	Album string
+
+	Kind PlanKind
+
+	Path string
+
+	Action PlanAction
+}
+
+// Plan describes what installing would do.
+type Plan struct {
+	Files []PlannedFile
+}
+
+func (a PlanAction) String() string {
+	switch a {
+	case PlanCreate:
+		return "create"
+	case PlanRegenerate:
+		return "regenerate"
+	case PlanKeep:
+		return "keep"
+	default:
+		return "unknown"
+	}
+}
+
+func (k PlanKind) String() string {
+	switch k {
+	case PlanThumbnail:
+		return "thumbnail"
+	case PlanLargeImage:
+		return "large image"
+	case PlanOriginal:
+		return "original"
+	case PlanPage:
+		return "page"
+	case PlanZip:
+		return "zip"
+	default:
+		return "unknown"
+	}
+}
+
+// Count returns how many files the plan has with the given action.
+func (p *Plan) Count(action PlanAction) int {
+	n := 0
+	for _, f := range p.Files {
+		if f.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// Plan loads gallery/albums information and works out what Install() would
+// do, without doing it. We don't change anything in InstallDir.
+func (g *Gallery) Plan() (*Plan, error) {
+	if err := g.Load(); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{}
+
+	// As in install(), protecting or unprotecting an album means making the
+	// index, map, and timeline again. Planning an album loads its lock.
+	force := g.ForceGenerateHTML
+
+	for _, album := range g.albums {
+		if err := album.plan(plan); err != nil {
+			return nil, fmt.Errorf("unable to plan album: %s: %s", album.Name, err)
+		}
+
+		if album.relock {
+			force = true
+		}
+	}
+
+	pages, err := g.indexPages()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range pages {
+		if err := plan.add("", PlanPage,
+			filepath.Join(g.InstallDir, albumPageFilename(i+1)),
+			force); err != nil {
+			return nil, err
+		}
+	}
+
+	if g.mapFeatures() != nil {
+		if err := plan.add("", PlanPage,
+			filepath.Join(g.InstallDir, mapPageFilename),
+			force); err != nil {
+			return nil, err
+		}
+	}
+
+	if g.Timeline {
+		for _, page := range timelinePages(g.timeline()) {
+			if err := plan.add("", PlanPage,
+				filepath.Join(g.InstallDir, timelineDir, page),
+				force); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// Plan loads image information and works out what Install() would do,
+// without doing it. We don't change anything in InstallDir.
+func (a *Album) Plan() (*Plan, error) {
+	if err := a.load(); err != nil {
+		return nil, fmt.Errorf("unable to parse metadata file: %s", err)
+	}
+
+	if err := a.ChooseImages(); err != nil {
+		return nil, fmt.Errorf("unable to choose images: %s", err)
+	}
+
+	plan := &Plan{}
+	if err := a.plan(plan); err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// plan adds the files installing the album would output to the plan. The
+// images must have been chosen already.
+func (a *Album) plan(plan *Plan) error {
+	if err := a.loadLock(); err != nil {
+		return err
+	}
+
+	for _, image := range a.chosenImages {
+		derivatives, err := image.derivatives(a.InstallDir)
+		if err != nil {
+			return fmt.Errorf("%s: %s", image.Filename, err)
+		}
+
+		for _, d := range derivatives {
+			kind := PlanLargeImage
+			if d.square {
+				kind = PlanThumbnail
+			}
+
+			if err := plan.add(a.Name, kind, d.path,
+				a.ForceGenerateImages || a.relock); err != nil {
+				return err
+			}
+		}
+	}
+
+	forceHTML := a.ForceGenerateHTML || a.relock
+
+	if a.protected() {
+		if err := plan.add(a.Name, PlanThumbnail,
+			filepath.Join(a.InstallDir, lockedThumbFilename),
+			forceHTML); err != nil {
+			return err
+		}
+	}
+
+	for i := range a.chosenImages {
+		if err := plan.add(a.Name, PlanPage,
+			filepath.Join(a.InstallDir, imagePageFilename(i)),
+			forceHTML); err != nil {
+			return err
+		}
+	}
+
+	if a.showMap() {
+		if err := plan.add(a.Name, PlanPage,
+			filepath.Join(a.InstallDir, mapPageFilename),
+			forceHTML); err != nil {
+			return err
+		}
+	}
+
+	for page := 1; (page-1)*a.PageSize < len(a.chosenImages); page++ {
+		if err := plan.add(a.Name, PlanPage,
+			filepath.Join(a.InstallDir, albumPageFilename(page)),
+			forceHTML); err != nil {
+			return err
+		}
+	}
+
+	if a.includeOriginals() {
+		for _, image := range a.chosenImages {
+			// We never replace originals.
+			if err := plan.add(a.Name, PlanOriginal,
+				filepath.Join(a.InstallDir, a.originalFilename(image)),
+				false); err != nil {
+				return err
+			}
+		}
+	}
+
+	if a.includeZip() {
+		if err := plan.add(a.Name, PlanZip, a.getZipPath(),
+			a.ForceGenerateZip); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// add adds a file to the plan. We decide the action based on whether the file
+// exists and whether we're forced to create it.
+func (p *Plan) add(album string, kind PlanKind, path string,
+	force bool) error {
+	exists, err := fileExists(path)
+	if err != nil {
+		return fmt.Errorf("failed to check if file exists: %s: %s", path, err)
+	}
+
+	action := PlanCreate
+	if exists {
+		action = PlanKeep
+		if force {
+			action = PlanRegenerate
+		}
+	}
+
+	p.Files = append(p.Files, PlannedFile{
+		Album:  album,
+		Kind:   kind,
+		Path:   path,
+		Action: action,
+	})
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package gallery
+
+import (
+	"fmt"
+	"image"
+	"sort"
+)
+
+// ImageProcessor decodes images so that we can create resized versions of
+// them.
+//
+// There is more than one implementation so that we are not tied to
+// ImageMagick. Each registers itself under a name. See NewImageProcessor().
+type ImageProcessor interface {
+	// Decode reads the image at the given path.
+	Decode(path string) (ProcessedImage, error)
+}
+
+// ProcessedImage is a decoded image. Its methods modify the image in place.
+//
+// You must call Close() when you are done with it.
+//
+// Pixels() is newer than the other methods. Implementations from before it
+// was added need it too.
+type ProcessedImage interface {
+	// Width in pixels.
+	Width() int
+
+	// Height in pixels.
+	Height() int
+
+	// AutoOrient rotates/flips the image so it displays the right way up
+	// according to its EXIF orientation.
+	AutoOrient() error
+
+	// Resize scales the image to exactly the given width and height.
+	Resize(width, height int) error
+
+	// Crop cuts the image down to the given width and height, starting at the
+	// given offset.
+	Crop(x, y, width, height int) error
+
+	// Encode writes the image to the given path. The format comes from the
+	// path's extension.
+	Encode(path string) error
+
+	// Pixels returns the image's pixels. With ImageMagick this goes by way of
+	// a temporary PNG, so it may be slow for large images.
+	Pixels() (image.Image, error)
+
+	// Close releases resources held by the image.
+	Close() error
+}
+
+// imageProcessors holds the available ImageProcessor implementations. Each
+// registers itself here when it is built in.
+var imageProcessors = map[string]func() ImageProcessor{}
+
+// registerImageProcessor makes an ImageProcessor available under a name.
+func registerImageProcessor(name string, f func() ImageProcessor) {
+	imageProcessors[name] = f
+}
+
+// NewImageProcessor returns the ImageProcessor with the given name.
+//
+// If name is blank, we return the default: ImageMagick if it is built in, and
+// the pure Go implementation otherwise.
+func NewImageProcessor(name string) (ImageProcessor, error) {
+	if name == "" {
+		return defaultImageProcessor(), nil
+	}
+
+	f, ok := imageProcessors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown image processor: %s", name)
+	}
+
+	return f(), nil
+}
+
+// ImageProcessorNames returns the names of the available ImageProcessors.
+func ImageProcessorNames() []string {
+	var names []string
+	for name := range imageProcessors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func defaultImageProcessor() ImageProcessor {
+	if f, ok := imageProcessors["magick"]; ok {
+		return f()
+	}
+	return imageProcessors["go"]()
+}
@@ -0,0 +1,196 @@
+package gallery
+
+import (
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// goProcessor is an ImageProcessor written in pure Go.
+//
+// It supports JPEG, PNG, and GIF. It does not need ImageMagick or cgo, but it
+// is slower and can't read HEIC or RAW formats.
+type goProcessor struct{}
+
+// goImage is an image decoded by goProcessor.
+type goImage struct {
+	image image.Image
+
+	// EXIF orientation of the original.
+	orientation int
+}
+
+// JPEG quality we encode with.
+const goJPEGQuality = 90
+
+func init() {
+	registerImageProcessor("go", func() ImageProcessor {
+		return goProcessor{}
+	})
+}
+
+// Decode reads an image using the standard library decoders.
+func (p goProcessor) Decode(path string) (ProcessedImage, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(fh)
+	if err != nil {
+		_ = fh.Close()
+		return nil, fmt.Errorf("unable to decode: %s: %s", path, err)
+	}
+
+	if err := fh.Close(); err != nil {
+		return nil, fmt.Errorf("close: %s", err)
+	}
+
+	// The image is usable without its EXIF. We just don't know which way up
+	// it goes.
+	orientation := 1
+	exif, err := readExif(path)
+	if err != nil {
+		log.Printf("Unable to read EXIF, not orienting: %s: %s", path, err)
+	} else {
+		orientation = exif.Orientation
+	}
+
+	return &goImage{
+		image:       img,
+		orientation: orientation,
+	}, nil
+}
+
+func (g *goImage) Width() int { return g.image.Bounds().Dx() }
+
+func (g *goImage) Height() int { return g.image.Bounds().Dy() }
+
+// AutoOrient applies the EXIF orientation.
+//
+// Orientations 2 through 8 are combinations of flips and rotations. See the
+// EXIF specification for the meaning of each.
+func (g *goImage) AutoOrient() error {
+	switch g.orientation {
+	case 0, 1:
+	case 2:
+		g.image = transform(g.image, false, true, false)
+	case 3:
+		g.image = transform(g.image, false, true, true)
+	case 4:
+		g.image = transform(g.image, false, false, true)
+	case 5:
+		g.image = transform(g.image, true, false, false)
+	case 6:
+		g.image = transform(g.image, true, true, false)
+	case 7:
+		g.image = transform(g.image, true, true, true)
+	case 8:
+		g.image = transform(g.image, true, false, true)
+	default:
+		return fmt.Errorf("invalid orientation: %d", g.orientation)
+	}
+
+	g.orientation = 1
+
+	return nil
+}
+
+// transform returns a copy of the image transposed (swapping x and y) and/or
+// flipped. The transpose happens first.
+func transform(src image.Image, transpose, flipX, flipY bool) image.Image {
+	b := src.Bounds()
+
+	width, height := b.Dx(), b.Dy()
+	if transpose {
+		width, height = height, width
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			srcX, srcY := x, y
+			if flipX {
+				srcX = width - 1 - x
+			}
+			if flipY {
+				srcY = height - 1 - y
+			}
+			if transpose {
+				srcX, srcY = srcY, srcX
+			}
+
+			dst.Set(x, y, src.At(b.Min.X+srcX, b.Min.Y+srcY))
+		}
+	}
+
+	return dst
+}
+
+func (g *goImage) Resize(width, height int) error {
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("invalid size: %dx%d", width, height)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), g.image, g.image.Bounds(), draw.Src,
+		nil)
+	g.image = dst
+
+	return nil
+}
+
+func (g *goImage) Crop(x, y, width, height int) error {
+	b := g.image.Bounds()
+
+	r := image.Rect(b.Min.X+x, b.Min.Y+y, b.Min.X+x+width, b.Min.Y+y+height)
+	if !r.In(b) {
+		return fmt.Errorf("crop %v is outside of image %v", r, b)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), g.image, r.Min, draw.Src)
+	g.image = dst
+
+	return nil
+}
+
+func (g *goImage) Encode(path string) error {
+	fh, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		err = jpeg.Encode(fh, g.image, &jpeg.Options{Quality: goJPEGQuality})
+	case ".png":
+		err = png.Encode(fh, g.image)
+	case ".gif":
+		err = gif.Encode(fh, g.image, nil)
+	default:
+		err = fmt.Errorf("unsupported format: %s", path)
+	}
+	if err != nil {
+		_ = fh.Close()
+		return err
+	}
+
+	return fh.Close()
+}
+
+func (g *goImage) Pixels() (image.Image, error) { return g.image, nil }
+
+func (g *goImage) Close() error {
+	g.image = nil
+	return nil
+}
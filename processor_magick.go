@@ -0,0 +1,105 @@
+//go:build !nomagick
+// +build !nomagick
+
+package gallery
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+
+	"github.com/horgh/magick"
+)
+
+// magickProcessor is an ImageProcessor using ImageMagick.
+//
+// It supports every format ImageMagick does, including HEIC and RAW formats if
+// it has the delegates for them. It requires cgo. Build with the nomagick tag
+// to leave it out.
+type magickProcessor struct{}
+
+// magickImage is an image decoded by ImageMagick.
+type magickImage struct {
+	image *magick.Image
+}
+
+func init() {
+	registerImageProcessor("magick", func() ImageProcessor {
+		return magickProcessor{}
+	})
+}
+
+// Decode reads an image using ImageMagick.
+func (p magickProcessor) Decode(path string) (ProcessedImage, error) {
+	image, err := magick.NewFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &magickImage{image: image}, nil
+}
+
+func (m *magickImage) Width() int { return m.image.Width() }
+
+func (m *magickImage) Height() int { return m.image.Height() }
+
+func (m *magickImage) AutoOrient() error { return m.image.AutoOrient() }
+
+func (m *magickImage) Resize(width, height int) error {
+	// ! says to ignore aspect ratio.
+	return m.image.Resize(fmt.Sprintf("%dx%d!", width, height))
+}
+
+func (m *magickImage) Crop(x, y, width, height int) error {
+	if err := m.image.Crop(fmt.Sprintf("%dx%d+%d+%d", width, height, x,
+		y)); err != nil {
+		return err
+	}
+
+	m.image.PlusRepage()
+
+	return nil
+}
+
+func (m *magickImage) Encode(path string) error { return m.image.ToFile(path) }
+
+// Pixels gets the pixels by way of a PNG. Our ImageMagick binding doesn't
+// give us them directly.
+func (m *magickImage) Pixels() (image.Image, error) {
+	fh, err := os.CreateTemp("", "gallery-pixels-*.png")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary file: %s", err)
+	}
+	tmpPath := fh.Name()
+	defer func() {
+		_ = os.Remove(tmpPath)
+	}()
+
+	if err := fh.Close(); err != nil {
+		return nil, fmt.Errorf("close: %s", err)
+	}
+
+	if err := m.image.ToFile(tmpPath); err != nil {
+		return nil, fmt.Errorf("unable to encode: %s", err)
+	}
+
+	fh, err = os.Open(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := png.Decode(fh)
+	if err != nil {
+		_ = fh.Close()
+		return nil, fmt.Errorf("unable to decode PNG: %s", err)
+	}
+
+	if err := fh.Close(); err != nil {
+		return nil, fmt.Errorf("close: %s", err)
+	}
+
+	return img, nil
+}
+
+func (m *magickImage) Close() error { return m.image.Destroy() }
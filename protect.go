@@ -0,0 +1,398 @@
+package gallery
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The files of a protected album that aren't pages or images.
+const (
+	// Holds the album's albumLock. The pages hold the salt too, so this need
+	// not be published, but nothing in it is secret.
+	lockFilename = ".protect.json"
+
+	// The gallery index shows this rather than one of the album's thumbnails.
+	lockedThumbFilename = "locked.svg"
+)
+
+// protectIterations is how many PBKDF2 iterations we derive keys with. This
+// is what OWASP recommends for PBKDF2-HMAC-SHA256.
+const protectIterations = 600000
+
+// protectCheck is what we encrypt to tell whether a password gives the key a
+// lock was made with.
+const protectCheck = "gallery"
+
+// albumLock is how we encrypt a password protected album. The key comes from
+// the password and the salt using PBKDF2. Check is protectCheck encrypted
+// with the key.
+//
+// We keep the lock in the album's install directory. We reuse it while the
+// password stays the same. This way we don't need to encrypt the album's
+// images again each time we install it.
+type albumLock struct {
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+	Check      []byte `json:"check"`
+
+	key []byte
+}
+
+// newAlbumLock makes a lock with a new salt.
+func newAlbumLock(password string) (*albumLock, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("unable to make salt: %s", err)
+	}
+
+	lock := &albumLock{
+		Salt:       salt,
+		Iterations: protectIterations,
+	}
+
+	if err := lock.deriveKey(password); err != nil {
+		return nil, err
+	}
+
+	check, err := encrypt(lock.key, []byte(protectCheck))
+	if err != nil {
+		return nil, err
+	}
+	lock.Check = check
+
+	return lock, nil
+}
+
+// readAlbumLock reads the lock in the directory. It returns nil if there is
+// none.
+func readAlbumLock(dir string) (*albumLock, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, lockFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	lock := &albumLock{}
+	if err := json.Unmarshal(buf, lock); err != nil {
+		return nil, fmt.Errorf("invalid lock: %s", err)
+	}
+
+	return lock, nil
+}
+
+// unlock derives the key from the password. It tells us whether it is the
+// key the lock was made with.
+func (l *albumLock) unlock(password string) (bool, error) {
+	if len(l.Salt) == 0 || l.Iterations <= 0 {
+		return false, nil
+	}
+
+	if err := l.deriveKey(password); err != nil {
+		return false, err
+	}
+
+	check, err := decrypt(l.key, l.Check)
+	if err != nil {
+		return false, nil
+	}
+
+	return string(check) == protectCheck, nil
+}
+
+func (l *albumLock) deriveKey(password string) error {
+	key, err := pbkdf2.Key(sha256.New, password, l.Salt, l.Iterations, 32)
+	if err != nil {
+		return fmt.Errorf("unable to derive key: %s", err)
+	}
+
+	l.key = key
+	return nil
+}
+
+// write saves the lock in the directory.
+func (l *albumLock) write(dir string) error {
+	buf, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("unable to encode lock: %s", err)
+	}
+
+	return writeFileAtomic(filepath.Join(dir, lockFilename),
+		func(w io.Writer) error {
+			_, err := w.Write(buf)
+			return err
+		})
+}
+
+// encrypt encrypts with AES-GCM. The result is the nonce followed by the
+// ciphertext. This is how the pages decrypt it.
+func encrypt(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("unable to make nonce: %s", err)
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decrypt reverses encrypt.
+func decrypt(key, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()],
+		ciphertext[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to make cipher: %s", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("unable to make GCM: %s", err)
+	}
+
+	return gcm, nil
+}
+
+// encryptFile encrypts the file in place. We use it on temporary files before
+// they're renamed into place, so the plain version is never where the pages
+// look for it.
+func encryptFile(path string, key []byte) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := encrypt(key, buf)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, ciphertext, 0644)
+}
+
+// writeAlbumTemplate executes the template and writes the result to path. If
+// the album is protected (lock is not nil), we write an unlock page holding
+// the result encrypted instead. title is the unlock page's title.
+func writeAlbumTemplate(path string, t *template.Template, data interface{},
+	lock *albumLock, title string, style template.CSS) error {
+	if lock == nil {
+		return writeTemplate(path, t, data)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, data); err != nil {
+		return fmt.Errorf("unable to execute template: %s", err)
+	}
+
+	payload, err := encrypt(lock.key, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	unlock, err := template.New("page").Parse(unlockTemplate)
+	if err != nil {
+		return fmt.Errorf("unable to parse HTML template: %s", err)
+	}
+
+	return writeTemplate(path, unlock, struct {
+		Title      string
+		CSS        template.CSS
+		Salt       []byte
+		Iterations int
+		Payload    []byte
+	}{
+		Title:      title,
+		CSS:        style,
+		Salt:       lock.Salt,
+		Iterations: lock.Iterations,
+		Payload:    payload,
+	})
+}
+
+// writeLockedThumb writes the placeholder thumbnail into the directory. It
+// returns whether we wrote it. We don't if it exists, unless forced.
+func writeLockedThumb(dir string, forceGenerate bool) (bool, error) {
+	path := filepath.Join(dir, lockedThumbFilename)
+	exists, err := fileExists(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if thumbnail exists: %s: %s",
+			path, err)
+	}
+
+	if !forceGenerate && exists {
+		return false, nil
+	}
+
+	if err := writeFileAtomic(path, func(w io.Writer) error {
+		_, err := io.WriteString(w, lockedThumb)
+		return err
+	}); err != nil {
+		return false, fmt.Errorf("unable to write thumbnail: %s", err)
+	}
+
+	return true, nil
+}
+
+// lockedThumb is the placeholder for a protected album's thumbnail.
+const lockedThumb = `<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" viewBox="0 0 100 100">
+<rect width="100" height="100" fill="#ddd"/>
+<rect x="30" y="45" width="40" height="30" rx="3" fill="#888"/>
+<path d="M38 45v-8a12 12 0 0 1 24 0v8" fill="none" stroke="#888" stroke-width="6"/>
+</svg>
+`
+
+// The unlock page asks for the password, derives the key, and decrypts the
+// page with WebCrypto. It replaces itself with the decrypted page. It then
+// fetches and decrypts the page's images.
+//
+// We keep the key for the rest of the browser session, so the album's other
+// pages open without asking again.
+const unlockTemplate = `<!DOCTYPE html>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<meta name="viewport" content="width=device-width, user-scalable=no">
+<meta name="robots" content="noindex">
+<style>{{.CSS}}</style>
+<h1>{{.Title}}</h1>
+
+<form id="unlock" hidden>
+	<p>This album is password protected.</p>
+	<input type="password" id="password" autofocus>
+	<button>Unlock</button>
+	<p id="message"></p>
+</form>
+
+<noscript>
+	<p>This album is password protected. Viewing it needs JavaScript.</p>
+</noscript>
+
+<script>
+"use strict";
+
+var salt = {{.Salt}};
+var iterations = {{.Iterations}};
+var payload = {{.Payload}};
+
+var storageKey = "gallery-key-" + salt;
+
+function fromBase64(s) {
+	return Uint8Array.from(atob(s), function(c) { return c.charCodeAt(0); });
+}
+
+function toBase64(buf) {
+	return btoa(String.fromCharCode.apply(null, new Uint8Array(buf)));
+}
+
+function decrypt(key, buf) {
+	var data = new Uint8Array(buf);
+	return crypto.subtle.decrypt({name: "AES-GCM", iv: data.subarray(0, 12)},
+		key, data.subarray(12));
+}
+
+function importKey(raw) {
+	return crypto.subtle.importKey("raw", raw, "AES-GCM", false, ["decrypt"]);
+}
+
+function deriveKey(password) {
+	return crypto.subtle.importKey("raw", new TextEncoder().encode(password),
+		"PBKDF2", false, ["deriveBits"]).then(function(base) {
+		return crypto.subtle.deriveBits({
+			name: "PBKDF2",
+			salt: fromBase64(salt),
+			iterations: iterations,
+			hash: "SHA-256"
+		}, base, 256);
+	});
+}
+
+// Replace the page with the decrypted one. Its images are encrypted too, so
+// we load them ourselves.
+function show(key, html) {
+	var doc = new DOMParser().parseFromString(html, "text/html");
+	var images = doc.querySelectorAll("img[src]");
+	images.forEach(function(img) {
+		img.setAttribute("data-src", img.getAttribute("src"));
+		img.removeAttribute("src");
+	});
+
+	document.open();
+	document.write("<!DOCTYPE html>" + doc.documentElement.outerHTML);
+	document.close();
+
+	document.querySelectorAll("img[data-src]").forEach(function(img) {
+		fetch(img.getAttribute("data-src")).then(function(resp) {
+			return resp.arrayBuffer();
+		}).then(function(buf) {
+			return decrypt(key, buf);
+		}).then(function(plain) {
+			img.src = URL.createObjectURL(new Blob([plain]));
+		});
+	});
+}
+
+function unlock(raw) {
+	return importKey(raw).then(function(key) {
+		return decrypt(key, fromBase64(payload)).then(function(plain) {
+			sessionStorage.setItem(storageKey, toBase64(raw));
+			show(key, new TextDecoder().decode(plain));
+		});
+	});
+}
+
+var form = document.getElementById("unlock");
+var message = document.getElementById("message");
+
+form.addEventListener("submit", function(evt) {
+	evt.preventDefault();
+	message.textContent = "Unlocking...";
+
+	deriveKey(document.getElementById("password").value).then(unlock)
+		.catch(function() {
+			message.textContent = "Wrong password.";
+		});
+});
+
+if (!window.crypto || !crypto.subtle) {
+	form.hidden = false;
+	message.textContent = "Your browser can't unlock this album here. It " +
+		"needs to be viewed over HTTPS.";
+} else {
+	var saved = sessionStorage.getItem(storageKey);
+	if (saved) {
+		unlock(fromBase64(saved)).catch(function() {
+			sessionStorage.removeItem(storageKey);
+			form.hidden = false;
+		});
+	} else {
+		form.hidden = false;
+	}
+}
+</script>
+`
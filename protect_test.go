@@ -0,0 +1,154 @@
+package gallery
+
+import (
+	"bytes"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	otherKey := bytes.Repeat([]byte{2}, 32)
+
+	tests := []string{"", "hello", strings.Repeat("long text ", 1000)}
+
+	for _, plaintext := range tests {
+		ciphertext, err := encrypt(key, []byte(plaintext))
+		if err != nil {
+			t.Fatalf("encrypt() = %s", err)
+		}
+
+		if len(plaintext) > 0 && bytes.Contains(ciphertext, []byte(plaintext)) {
+			t.Errorf("ciphertext contains the plaintext: %q", plaintext)
+		}
+
+		got, err := decrypt(key, ciphertext)
+		if err != nil {
+			t.Errorf("decrypt() = %s", err)
+			continue
+		}
+		if string(got) != plaintext {
+			t.Errorf("decrypt() = %q, wanted %q", got, plaintext)
+		}
+
+		if _, err := decrypt(otherKey, ciphertext); err == nil {
+			t.Errorf("decrypt() with the wrong key succeeded")
+		}
+
+		ciphertext[len(ciphertext)-1] ^= 1
+		if _, err := decrypt(key, ciphertext); err == nil {
+			t.Errorf("decrypt() of altered ciphertext succeeded")
+		}
+	}
+
+	if _, err := decrypt(key, []byte("short")); err == nil {
+		t.Errorf("decrypt() of short ciphertext succeeded")
+	}
+}
+
+func TestAlbumLock(t *testing.T) {
+	dir := t.TempDir()
+
+	lock, err := newAlbumLock("secret")
+	if err != nil {
+		t.Fatalf("newAlbumLock() = %s", err)
+	}
+
+	if err := lock.write(dir); err != nil {
+		t.Fatalf("write() = %s", err)
+	}
+
+	buf, err := os.ReadFile(filepath.Join(dir, lockFilename))
+	if err != nil {
+		t.Fatalf("unable to read lock: %s", err)
+	}
+	if bytes.Contains(buf, lock.key) || strings.Contains(string(buf), "secret") {
+		t.Errorf("lock file holds the key or password: %s", buf)
+	}
+
+	read, err := readAlbumLock(dir)
+	if err != nil {
+		t.Fatalf("readAlbumLock() = %s", err)
+	}
+
+	ok, err := read.unlock("wrong")
+	if err != nil {
+		t.Fatalf("unlock() = %s", err)
+	}
+	if ok {
+		t.Errorf("unlock() with the wrong password succeeded")
+	}
+
+	ok, err = read.unlock("secret")
+	if err != nil {
+		t.Fatalf("unlock() = %s", err)
+	}
+	if !ok {
+		t.Errorf("unlock() with the right password failed")
+	}
+	if !bytes.Equal(read.key, lock.key) {
+		t.Errorf("unlock() gave a different key")
+	}
+
+	none, err := readAlbumLock(t.TempDir())
+	if err != nil || none != nil {
+		t.Errorf("readAlbumLock() of a directory without one = %v, %v", none,
+			err)
+	}
+}
+
+func TestWriteAlbumTemplate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "index.html")
+
+	lock, err := newAlbumLock("secret")
+	if err != nil {
+		t.Fatalf("newAlbumLock() = %s", err)
+	}
+
+	tpl := template.Must(template.New("page").Parse(
+		`<p>{{.Description}}</p><img src="{{.Image}}">`))
+	data := struct {
+		Description string
+		Image       string
+	}{"A private description", "private_595.jpg"}
+
+	if err := writeAlbumTemplate(path, tpl, data, lock, "Album",
+		""); err != nil {
+		t.Fatalf("writeAlbumTemplate() = %s", err)
+	}
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read page: %s", err)
+	}
+
+	for _, plaintext := range []string{"private", "secret"} {
+		if strings.Contains(string(buf), plaintext) {
+			t.Errorf("page contains %q: %s", plaintext, buf)
+		}
+	}
+
+	if !strings.Contains(string(buf), "<title>Album</title>") {
+		t.Errorf("page is missing its title: %s", buf)
+	}
+
+	// Without a lock we write the page as it is.
+	if err := writeAlbumTemplate(path, tpl, data, nil, "Album",
+		""); err != nil {
+		t.Fatalf("writeAlbumTemplate() = %s", err)
+	}
+
+	buf, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read page: %s", err)
+	}
+
+	want := `<p>A private description</p><img src="private_595.jpg">`
+	if string(buf) != want {
+		t.Errorf("page = %q, wanted %q", buf, want)
+	}
+}
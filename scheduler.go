@@ -0,0 +1,158 @@
+package gallery
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// scheduler runs jobs concurrently. It limits how many run at once, and how
+// much memory (as estimated by each job) they use at once.
+//
+// Submitting a job blocks until it starts, so jobs from one submitter start
+// in order. A job that would go over the memory budget waits until enough
+// running jobs finish, and jobs its submitter has after it wait behind it. A job
+// estimated to use more than the entire budget runs once nothing else is
+// running.
+//
+// Once a job's context is cancelled, we don't start it.
+type scheduler struct {
+	// Maximum number of jobs to run at once.
+	workers int
+
+	// Maximum memory in bytes that running jobs may use. 0 means no limit.
+	memoryBudget int64
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	running int
+	memory  int64
+}
+
+// jobGroup is a set of jobs run by a scheduler that we wait on together.
+//
+// A scheduler may be shared, such as by all albums in a gallery. Each album
+// uses its own groups.
+type jobGroup struct {
+	ctx       context.Context
+	scheduler *scheduler
+
+	wg sync.WaitGroup
+
+	mutex sync.Mutex
+	err   error
+}
+
+// newScheduler creates a scheduler.
+//
+// If workers is not positive, we use the number of CPUs.
+func newScheduler(workers int, memoryBudget int64) *scheduler {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	s := &scheduler{
+		workers:      workers,
+		memoryBudget: memoryBudget,
+	}
+	s.cond = sync.NewCond(&s.mutex)
+
+	return s
+}
+
+// run starts the job in a goroutine once the limits allow it. It blocks until
+// then.
+//
+// memory is the job's estimated memory use in bytes.
+//
+// If the context is cancelled before the job starts, we don't start it and
+// return the context's error.
+func (s *scheduler) run(ctx context.Context, memory int64, job func()) error {
+	if s.memoryBudget > 0 && memory > s.memoryBudget {
+		memory = s.memoryBudget
+	}
+
+	// Wake up if we're cancelled while waiting.
+	stop := context.AfterFunc(ctx, func() {
+		s.mutex.Lock()
+		s.cond.Broadcast()
+		s.mutex.Unlock()
+	})
+	defer stop()
+
+	s.mutex.Lock()
+	for {
+		if err := ctx.Err(); err != nil {
+			s.mutex.Unlock()
+			return err
+		}
+
+		if s.running < s.workers &&
+			(s.memoryBudget == 0 || s.running == 0 ||
+				s.memory+memory <= s.memoryBudget) {
+			break
+		}
+
+		s.cond.Wait()
+	}
+	s.running++
+	s.memory += memory
+	s.mutex.Unlock()
+
+	go func() {
+		defer s.release(memory)
+		job()
+	}()
+
+	return nil
+}
+
+func (s *scheduler) release(memory int64) {
+	s.mutex.Lock()
+	s.running--
+	s.memory -= memory
+	s.mutex.Unlock()
+
+	s.cond.Broadcast()
+}
+
+// group creates a new jobGroup using the scheduler. Its jobs don't start once
+// the context is cancelled.
+func (s *scheduler) group(ctx context.Context) *jobGroup {
+	return &jobGroup{
+		ctx:       ctx,
+		scheduler: s,
+	}
+}
+
+// run runs the job using the group's scheduler. See scheduler.run().
+func (g *jobGroup) run(memory int64, job func() error) {
+	g.wg.Add(1)
+	if err := g.scheduler.run(g.ctx, memory, func() {
+		defer g.wg.Done()
+		g.setErr(job())
+	}); err != nil {
+		g.wg.Done()
+		g.setErr(err)
+	}
+}
+
+// setErr records the error if it is the first.
+func (g *jobGroup) setErr(err error) {
+	if err == nil {
+		return
+	}
+
+	g.mutex.Lock()
+	if g.err == nil {
+		g.err = err
+	}
+	g.mutex.Unlock()
+}
+
+// wait blocks until all of the group's jobs finish. It returns the first
+// error a job returned, if any.
+func (g *jobGroup) wait() error {
+	g.wg.Wait()
+	return g.err
+}
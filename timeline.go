@@ -0,0 +1,372 @@
+package gallery
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// timelineDir is the directory in the install directory holding the timeline
+// pages.
+const timelineDir = "timeline"
+
+// timelineImage is an image on the timeline. It links to the image's page in
+// its album.
+type timelineImage struct {
+	URL      string
+	ThumbURL string
+	Name     string
+	Album    string
+	time     time.Time
+}
+
+// timelineMonth holds the images taken in a month.
+type timelineMonth struct {
+	Year   int
+	Month  time.Month
+	Images []timelineImage
+}
+
+// URL returns the filename of the month's page.
+func (m *timelineMonth) URL() string {
+	return timelineMonthFilename(m.Year, m.Month)
+}
+
+// timelineYear holds the months of a year. It has all 12 months. Those
+// without images have none.
+type timelineYear struct {
+	Year   int
+	Months []*timelineMonth
+}
+
+// URL returns the filename of the year's page.
+func (y *timelineYear) URL() string {
+	return timelineYearFilename(y.Year)
+}
+
+// Count returns how many images the year has.
+func (y *timelineYear) Count() int {
+	n := 0
+	for _, m := range y.Months {
+		n += len(m.Images)
+	}
+	return n
+}
+
+func timelineYearFilename(year int) string {
+	return fmt.Sprintf("%d.html", year)
+}
+
+func timelineMonthFilename(year int, month time.Month) string {
+	return fmt.Sprintf("%d-%02d.html", year, month)
+}
+
+// timeline arranges the images of all albums by when they were taken. We
+// return the years newest first.
+//
+// We only include images that say when they were taken (in their EXIF data).
+// If more than one album has an image, we link to the first. We leave out
+// protected albums. The albums' images must have been chosen.
+func (g *Gallery) timeline() []*timelineYear {
+	seen := map[string]bool{}
+	byMonth := map[string]*timelineMonth{}
+	var months []*timelineMonth
+
+	for _, album := range g.albums {
+		if album.protected() {
+			continue
+		}
+
+		for i, image := range album.chosenImages {
+			if seen[image.Path] {
+				continue
+			}
+			seen[image.Path] = true
+
+			t, err := CaptureTime(image.Path)
+			if err != nil || t.IsZero() {
+				continue
+			}
+
+			key := timelineMonthFilename(t.Year(), t.Month())
+			month, ok := byMonth[key]
+			if !ok {
+				month = &timelineMonth{Year: t.Year(), Month: t.Month()}
+				byMonth[key] = month
+				months = append(months, month)
+			}
+
+			month.Images = append(month.Images, timelineImage{
+				URL: fmt.Sprintf("../%s/%s", album.InstallSubDir,
+					imagePageFilename(i)),
+				ThumbURL: fmt.Sprintf("../%s/%s", album.InstallSubDir,
+					image.ThumbnailFilename),
+				Name:  image.Filename,
+				Album: album.Name,
+				time:  t,
+			})
+		}
+	}
+
+	byYear := map[int]*timelineYear{}
+	var years []*timelineYear
+
+	for _, month := range months {
+		sort.SliceStable(month.Images, func(i, j int) bool {
+			return month.Images[i].time.Before(month.Images[j].time)
+		})
+
+		year, ok := byYear[month.Year]
+		if !ok {
+			year = &timelineYear{Year: month.Year}
+			for m := time.January; m <= time.December; m++ {
+				year.Months = append(year.Months,
+					&timelineMonth{Year: month.Year, Month: m})
+			}
+			byYear[month.Year] = year
+			years = append(years, year)
+		}
+
+		year.Months[month.Month-1] = month
+	}
+
+	sort.Slice(years, func(i, j int) bool {
+		return years[i].Year > years[j].Year
+	})
+
+	return years
+}
+
+// timelinePages returns the filenames of the timeline's pages, relative to
+// the timeline directory.
+func timelinePages(years []*timelineYear) []string {
+	pages := []string{"index.html"}
+
+	for _, year := range years {
+		pages = append(pages, year.URL())
+
+		for _, month := range year.Months {
+			if len(month.Images) > 0 {
+				pages = append(pages, month.URL())
+			}
+		}
+	}
+
+	return pages
+}
+
+// installTimeline writes the timeline pages. There is an overview page
+// showing a calendar of each year, a page for each year, and a page for each
+// month with images.
+//
+// We call onWritten with the path of each page we write.
+func (g *Gallery) installTimeline(style template.CSS, forceGenerate bool,
+	onWritten func(path string, start time.Time)) error {
+	dir := filepath.Join(g.InstallDir, timelineDir)
+	if err := makeDirIfNotExist(dir); err != nil {
+		return err
+	}
+
+	years := g.timeline()
+
+	baseURL := ""
+	if g.BaseURL != "" {
+		baseURL = pageURL(g.BaseURL, timelineDir)
+	}
+
+	start := time.Now()
+	written, err := makeTimelineHTML(dir, "index.html", timelineIndexTemplate,
+		g.Name, years, style, baseURL, g.Verbose, forceGenerate)
+	if err != nil {
+		return err
+	}
+	if written {
+		onWritten(filepath.Join(dir, "index.html"), start)
+	}
+
+	for i, year := range years {
+		// Years are newest first.
+		var newer, older *timelineYear
+		if i > 0 {
+			newer = years[i-1]
+		}
+		if i < len(years)-1 {
+			older = years[i+1]
+		}
+
+		start := time.Now()
+		written, err := makeTimelineHTML(dir, year.URL(), timelineYearTemplate,
+			g.Name, struct {
+				*timelineYear
+				Newer *timelineYear
+				Older *timelineYear
+			}{year, newer, older}, style, baseURL, g.Verbose, forceGenerate)
+		if err != nil {
+			return err
+		}
+		if written {
+			onWritten(filepath.Join(dir, year.URL()), start)
+		}
+
+		for _, month := range year.Months {
+			if len(month.Images) == 0 {
+				continue
+			}
+
+			start := time.Now()
+			written, err := makeTimelineHTML(dir, month.URL(),
+				timelineMonthTemplate, g.Name, month, style, baseURL, g.Verbose,
+				forceGenerate)
+			if err != nil {
+				return err
+			}
+			if written {
+				onWritten(filepath.Join(dir, month.URL()), start)
+			}
+		}
+	}
+
+	return nil
+}
+
+// makeTimelineHTML writes a timeline page using the given template. data is
+// what the page is about. The template gets it as .Data.
+func makeTimelineHTML(dir, filename, tpl, galleryName string,
+	data interface{}, style template.CSS, baseURL string, verbose,
+	forceGenerate bool) (bool, error) {
+	htmlPath := filepath.Join(dir, filename)
+	exists, err := fileExists(htmlPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if HTML exists: %s: %s", htmlPath, err)
+	}
+
+	if !forceGenerate && exists {
+		return false, nil
+	}
+
+	t, err := template.New("page").Parse(timelineHeaderTemplate + tpl)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse HTML template: %s", err)
+	}
+
+	pageData := struct {
+		GalleryName string
+		Data        interface{}
+		CSS         template.CSS
+		URL         string
+	}{
+		GalleryName: galleryName,
+		Data:        data,
+		CSS:         style,
+		URL:         pageURL(baseURL, filename),
+	}
+
+	if err := writeTemplate(htmlPath, t, pageData); err != nil {
+		return false, err
+	}
+
+	if verbose {
+		log.Printf("Wrote HTML file: %s", htmlPath)
+	}
+	return true, nil
+}
+
+const timelineHeaderTemplate = `<!DOCTYPE html>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, user-scalable=no">
+<style>{{.CSS}}</style>
+{{if .URL}}<link rel="canonical" href="{{.URL}}">{{end}}
+`
+
+// The overview page. It shows each year as a row of months with the number
+// of images taken in each.
+const timelineIndexTemplate = `<title>Timeline - {{.GalleryName}}</title>
+<h1>Timeline</h1>
+
+<div id="nav">
+	Navigation:
+	<a href="../index.html">Back to {{.GalleryName}}</a>
+</div>
+
+{{if not .Data}}
+<p>No images say when they were taken.</p>
+{{else}}
+<table class="calendar">
+	<tr>
+		<th></th>
+		<th>Jan</th><th>Feb</th><th>Mar</th><th>Apr</th><th>May</th><th>Jun</th>
+		<th>Jul</th><th>Aug</th><th>Sep</th><th>Oct</th><th>Nov</th><th>Dec</th>
+	</tr>
+	{{range .Data}}
+	<tr>
+		<th><a href="{{.URL}}">{{.Year}}</a></th>
+		{{range .Months}}
+			{{if .Images}}
+				<td><a href="{{.URL}}">{{len .Images}}</a></td>
+			{{else}}
+				<td></td>
+			{{end}}
+		{{end}}
+	</tr>
+	{{end}}
+</table>
+{{end}}
+`
+
+// A year's page. It shows each month with images, with the first few of
+// them.
+const timelineYearTemplate = `<title>{{.Data.Year}} - {{.GalleryName}}</title>
+<h1>{{.Data.Year}} ({{.Data.Count}} images)</h1>
+
+<div id="nav">
+	Navigation:
+	<a href="index.html">Back to timeline</a>
+	{{if .Data.Older}}
+		| <a href="{{.Data.Older.URL}}">{{.Data.Older.Year}}</a>
+	{{end}}
+	{{if .Data.Newer}}
+		| <a href="{{.Data.Newer.URL}}">{{.Data.Newer.Year}}</a>
+	{{end}}
+</div>
+
+<div id="months">
+	{{range .Data.Months}}
+		<div class="month">
+			{{if .Images}}
+				<h2><a href="{{.URL}}">{{.Month}}</a> ({{len .Images}} images)</h2>
+				{{range $i, $image := .Images}}
+					{{if lt $i 4}}
+						<a href="{{$image.URL}}"><img src="{{$image.ThumbURL}}" alt="{{$image.Name}}"></a>
+					{{end}}
+				{{end}}
+			{{else}}
+				<h2>{{.Month}}</h2>
+			{{end}}
+		</div>
+	{{end}}
+</div>
+`
+
+// A month's page. It shows all of the month's images.
+const timelineMonthTemplate = `<title>{{.Data.Month}} {{.Data.Year}} - {{.GalleryName}}</title>
+<h1>{{.Data.Month}} {{.Data.Year}} ({{len .Data.Images}} images)</h1>
+
+<div id="nav">
+	Navigation:
+	<a href="index.html">Back to timeline</a> |
+	<a href="{{.Data.Year}}.html">Back to {{.Data.Year}}</a>
+</div>
+
+<div id="images">
+	{{range .Data.Images}}
+		<div class="image">
+			<a href="{{.URL}}" title="{{.Album}}: {{.Name}}">
+				<img src="{{.ThumbURL}}" alt="{{.Name}}">
+			</a>
+		</div>
+	{{end}}
+</div>
+`
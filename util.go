@@ -4,9 +4,13 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 // copyFile copies the file!
+//
+// We write dest atomically. See writeFileAtomic().
 func copyFile(src string, dest string) error {
 	if src == dest {
 		return nil
@@ -17,24 +21,84 @@ func copyFile(src string, dest string) error {
 		return fmt.Errorf("unable to open file (read): %s", err)
 	}
 
-	destFD, err := os.Create(dest)
-	if err != nil {
-		_ = srcFD.Close()
-		return fmt.Errorf("unable to open file (write): %s", err)
-	}
-
-	if _, err := io.Copy(destFD, srcFD); err != nil {
+	if err := writeFileAtomic(dest, func(w io.Writer) error {
+		if _, err := io.Copy(w, srcFD); err != nil {
+			return fmt.Errorf("unable to copy file: %s", err)
+		}
+		return nil
+	}); err != nil {
 		_ = srcFD.Close()
-		_ = destFD.Close()
-		return fmt.Errorf("unable to copy file: %s", err)
+		return err
 	}
 
 	if err := srcFD.Close(); err != nil {
 		return fmt.Errorf("close: %s: %s", src, err)
 	}
 
-	if err := destFD.Close(); err != nil {
-		return fmt.Errorf("close: %s: %s", dest, err)
+	return nil
+}
+
+// writeFileAtomic creates the file at path with content written by the write
+// function.
+//
+// We write to a temporary file in the same directory and then rename it into
+// place. This means that if we fail or are interrupted part way, we don't
+// leave a partial file at path. This matters because we skip creating files
+// that exist.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	return createFileAtomic(path, func(tmpPath string) error {
+		fh, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return fmt.Errorf("unable to open file (write): %s", err)
+		}
+
+		if err := write(fh); err != nil {
+			_ = fh.Close()
+			return err
+		}
+
+		if err := fh.Close(); err != nil {
+			return fmt.Errorf("close: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// createFileAtomic is like writeFileAtomic() except create is given the path
+// to the temporary file to write. This is for when something else opens the
+// file, such as an image encoder.
+//
+// The temporary file has the same extension as path since some encoders
+// decide on the format from it.
+func createFileAtomic(path string, create func(tmpPath string) error) error {
+	fh, err := os.CreateTemp(filepath.Dir(path),
+		"."+strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))+
+			".*.tmp"+filepath.Ext(path))
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file: %s", err)
+	}
+	tmpPath := fh.Name()
+
+	if err := fh.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("close: %s: %s", tmpPath, err)
+	}
+
+	// CreateTemp makes the file readable only by us.
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("chmod: %s: %s", tmpPath, err)
+	}
+
+	if err := create(tmpPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("rename: %s to %s: %s", tmpPath, path, err)
 	}
 
 	return nil
@@ -0,0 +1,118 @@
+package gallery
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// WatchPaths returns the paths the gallery is built from: the gallery files,
+// each album file (for albums with one), and each album's directory of
+// original images.
+//
+// For each album-glob, we include the directory its matches are in, and the
+// album file of each directory matching it, whether there is one yet or not.
+// This way we see new albums appear. We match the pattern again each time.
+//
+// The gallery must be loaded, such as by Install() or Plan().
+func (g *Gallery) WatchPaths() []string {
+	paths := append([]string(nil), g.GalleryFiles()...)
+
+	for _, album := range g.albums {
+		if album.File != "" {
+			paths = append(paths, album.File)
+		}
+		paths = append(paths, album.OrigImageDir)
+	}
+
+	for _, block := range g.globs {
+		paths = append(paths, globBase(block.glob))
+
+		if block.globFile == "" {
+			continue
+		}
+
+		// The pattern is valid. We checked when reading it.
+		dirs, _ := filepath.Glob(block.glob)
+		for _, dir := range dirs {
+			paths = append(paths, filepath.Join(dir, block.globFile))
+		}
+	}
+
+	return paths
+}
+
+// Rebuild installs the gallery again after the given paths changed. This is
+// for when we're watching WatchPaths() for changes.
+//
+// We regenerate the HTML of albums built from a changed path, and the resized
+// versions of changed original images. If the gallery file changed, we
+// regenerate all HTML. We always regenerate the gallery index page. Other
+// files we create only if they don't exist, as usual.
+func (g *Gallery) Rebuild(ctx context.Context, changed []string) error {
+	if err := g.load(g.File); err != nil {
+		return fmt.Errorf("unable to load gallery file: %s", err)
+	}
+
+	galleryChanged := false
+	for _, path := range changed {
+		if g.IsGalleryFile(path) {
+			galleryChanged = true
+			break
+		}
+	}
+
+	for _, album := range g.albums {
+		album.changedImages = map[string]bool{}
+
+		for _, path := range changed {
+			if galleryChanged ||
+				(album.File != "" && samePath(path, album.File)) {
+				album.ForceGenerateHTML = true
+				continue
+			}
+
+			if isInDir(path, album.OrigImageDir) {
+				album.ForceGenerateHTML = true
+				album.changedImages[filepath.Join(album.OrigImageDir,
+					filepath.Base(path))] = true
+			}
+		}
+	}
+
+	return g.install(ctx, true)
+}
+
+// GalleryFiles returns the gallery file and any files it includes.
+//
+// The gallery must be loaded, such as by Install() or Plan().
+func (g *Gallery) GalleryFiles() []string {
+	if len(g.files) == 0 {
+		return []string{g.File}
+	}
+	return g.files
+}
+
+// IsGalleryFile tells us whether the path is the gallery file or one it
+// includes.
+func (g *Gallery) IsGalleryFile(path string) bool {
+	for _, file := range g.GalleryFiles() {
+		if samePath(path, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// samePath tells us whether the two paths refer to the same file, going by
+// their names.
+func samePath(a, b string) bool {
+	return filepath.Clean(a) == filepath.Clean(b)
+}
+
+// isInDir tells us whether path is directly inside dir.
+func isInDir(path, dir string) bool {
+	return samePath(filepath.Dir(path), dir) &&
+		!strings.HasPrefix(filepath.Base(path), ".")
+}